@@ -0,0 +1,220 @@
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var countByExpr string
+var bucketSize time.Duration
+var histogram bool
+
+// groupKey is built from --count-by and --bucket in Run. When it is set,
+// matches are counted per key instead of being printed.
+var groupKey *groupKeyer
+
+// noGroupKey is the key of matches that --count-by or --bucket found nothing in.
+const noGroupKey = "(none)"
+
+// histogramWidth is the length of the longest bar --histogram draws.
+const histogramWidth = 50
+
+// maxBucketRows bounds how many empty buckets are filled in between the
+// first and last timestamps seen.
+const maxBucketRows = 10000
+
+// timestampPattern finds the timestamp --bucket uses when --count-by is not
+// given, e.g. 2025-05-19T10:04:05Z or 2025-05-19 10:04:05.123.
+var timestampPattern = regexp.MustCompile(`\d{4}-\d{2}-\d{2}[T ]\d{2}:\d{2}:\d{2}(?:[.,]\d+)?(?:Z|[+-]\d{2}:?\d{2})?`)
+
+var timestampLayouts = []string{
+	"2006-01-02T15:04:05.999999999Z07:00",
+	"2006-01-02T15:04:05.999999999Z0700",
+	"2006-01-02T15:04:05.999999999",
+	"2006-01-02 15:04:05.999999999Z07:00",
+	"2006-01-02 15:04:05.999999999Z0700",
+	"2006-01-02 15:04:05.999999999",
+}
+
+// groupKeyer derives the aggregation key of a matching line: the first
+// capture group of --count-by (or its whole match if it has no groups),
+// optionally parsed as a timestamp and truncated to a --bucket.
+type groupKeyer struct {
+	pattern *regexp.Regexp
+	group   int
+	bucket  time.Duration
+}
+
+func newGroupKeyer(expr string, bucket time.Duration) (*groupKeyer, error) {
+	if bucket < 0 {
+		return nil, fmt.Errorf("invalid --bucket %s: must be positive", bucket)
+	}
+
+	k := &groupKeyer{pattern: timestampPattern, bucket: bucket}
+	if expr != "" {
+		pattern, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid --count-by: %v", err)
+		}
+		k.pattern = pattern
+		if pattern.NumSubexp() > 0 {
+			k.group = 1
+		}
+	}
+	return k, nil
+}
+
+// key returns the group line belongs to, or noGroupKey.
+func (k *groupKeyer) key(line string) string {
+	match := k.pattern.FindStringSubmatchIndex(line)
+	if match == nil || match[2*k.group] < 0 {
+		return noGroupKey
+	}
+	key := line[match[2*k.group]:match[2*k.group+1]]
+
+	if k.bucket == 0 {
+		return key
+	}
+	t, ok := parseTimestamp(key)
+	if !ok {
+		return noGroupKey
+	}
+	return t.Truncate(k.bucket).Format(time.RFC3339)
+}
+
+func parseTimestamp(s string) (time.Time, bool) {
+	s = strings.Replace(s, ",", ".", 1)
+	for _, layout := range timestampLayouts {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// matchGroups accumulates per-key counts across every input searched.
+type matchGroups struct {
+	mu     sync.Mutex
+	counts map[string]int
+}
+
+var groups = &matchGroups{}
+
+func (g *matchGroups) add(counts map[string]int) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.counts == nil {
+		g.counts = make(map[string]int)
+	}
+	for key, count := range counts {
+		g.counts[key] += count
+	}
+}
+
+type groupRow struct {
+	key   string
+	count int
+}
+
+// rows returns the counts sorted by descending count, or chronologically
+// with empty buckets filled in when bucket is set. Matches without a key
+// come last.
+func (g *matchGroups) rows(bucket time.Duration) []groupRow {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	var rows []groupRow
+	if bucket > 0 {
+		rows = bucketRows(g.counts, bucket)
+	} else {
+		for key, count := range g.counts {
+			if key != noGroupKey {
+				rows = append(rows, groupRow{key, count})
+			}
+		}
+		sort.Slice(rows, func(i, j int) bool {
+			if rows[i].count != rows[j].count {
+				return rows[i].count > rows[j].count
+			}
+			return rows[i].key < rows[j].key
+		})
+	}
+
+	if count := g.counts[noGroupKey]; count > 0 {
+		rows = append(rows, groupRow{noGroupKey, count})
+	}
+	return rows
+}
+
+func bucketRows(counts map[string]int, bucket time.Duration) []groupRow {
+	byTime := make(map[int64]int)
+	var times []time.Time
+	for key, count := range counts {
+		t, err := time.Parse(time.RFC3339, key)
+		if err != nil {
+			continue
+		}
+		if _, seen := byTime[t.Unix()]; !seen {
+			times = append(times, t)
+		}
+		byTime[t.Unix()] += count
+	}
+	if len(times) == 0 {
+		return nil
+	}
+	sort.Slice(times, func(i, j int) bool { return times[i].Before(times[j]) })
+
+	var rows []groupRow
+	first, last := times[0], times[len(times)-1]
+	if last.Sub(first)/bucket >= maxBucketRows {
+		// too sparse to fill in; list only the buckets that have matches
+		for _, t := range times {
+			rows = append(rows, groupRow{t.Format(time.RFC3339), byTime[t.Unix()]})
+		}
+		return rows
+	}
+	for t := first; !t.After(last); t = t.Add(bucket) {
+		rows = append(rows, groupRow{t.Format(time.RFC3339), byTime[t.Unix()]})
+	}
+	return rows
+}
+
+// writeGroups prints the aggregated counts as a table, or as a bar chart
+// with --histogram.
+func writeGroups(w io.Writer, rows []groupRow) {
+	if len(rows) == 0 {
+		return
+	}
+
+	keyWidth, countWidth, maxCount := 0, 0, 0
+	for _, row := range rows {
+		keyWidth = max(keyWidth, len(row.key))
+		countWidth = max(countWidth, len(strconv.Itoa(row.count)))
+		maxCount = max(maxCount, row.count)
+	}
+
+	if !histogram {
+		countWidth = max(countWidth, len("COUNT"))
+		fmt.Fprintf(w, "%*s  %s\n", countWidth, "COUNT", "KEY")
+		for _, row := range rows {
+			fmt.Fprintf(w, "%*d  %s\n", countWidth, row.count, row.key)
+		}
+		return
+	}
+
+	for _, row := range rows {
+		bar := 0
+		if maxCount > 0 && row.count > 0 {
+			bar = max(1, row.count*histogramWidth/maxCount)
+		}
+		line := fmt.Sprintf("%-*s  %*d %s", keyWidth, row.key, countWidth, row.count, strings.Repeat("#", bar))
+		fmt.Fprintln(w, strings.TrimRight(line, " "))
+	}
+}
@@ -0,0 +1,339 @@
+package cmd
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// parallelChunkThreshold is the size from which a regular file is split into
+// newline-aligned chunks that are searched concurrently.
+var parallelChunkThreshold int64 = 64 << 20
+
+// lineRecord is a line kept for output: a match, or a line that may turn
+// out to be context for one.
+type lineRecord struct {
+	number int64 // 1-based, relative to the chunk until merged
+	text   string
+	prefix string
+	match  bool
+}
+
+// chunkResult is what scanLines found in one chunk of input.
+type chunkResult struct {
+	records []lineRecord
+	lines   int64
+	count   int
+	groups  map[string]int // matches per --count-by key
+	err     error
+	errLine int64 // line that caused err, 0 if err is not about a line
+}
+
+// grepFile searches file, through --pre if it applies, through a memory
+// mapping if it is a large regular file, and split across goroutines if it is
+// larger still. The output is identical to grepReader's.
+func grepFile(ctx context.Context, searchString string, file *os.File) ([]string, error) {
+	if file != os.Stdin && usePreprocessor(file.Name()) {
+		return grepPreprocessed(ctx, searchString, file)
+	}
+
+	workers := runtime.GOMAXPROCS(0)
+	info, err := file.Stat()
+	if err == nil && file != os.Stdin && useMmap(info) {
+		matches, err := grepMapped(ctx, searchString, file, info.Size(), workers)
+		if !errors.Is(err, errMapFailed) {
+			return matches, err
+		}
+		// read it after all, from the start and at its current size
+		if _, err := file.Seek(0, io.SeekStart); err != nil {
+			return nil, err
+		}
+		info, err = file.Stat()
+		if err != nil {
+			return nil, err
+		}
+	}
+	if err != nil || !info.Mode().IsRegular() || info.Size() < parallelChunkThreshold || workers < 2 {
+		return grepReader(ctx, searchString, file)
+	}
+
+	// stdin redirected from a file may already be partly read, as by
+	// `(head -n 1; mygrep foo) < file`, so search only what's left of it
+	start, err := file.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return nil, err
+	}
+	rest := io.NewSectionReader(file, start, info.Size()-start)
+	return grepChunks(ctx, searchString, rest, rest.Size(), workers)
+}
+
+// grepChunks searches the first size bytes of r in n concurrent chunks.
+func grepChunks(ctx context.Context, searchString string, r io.ReaderAt, size int64, n int) ([]string, error) {
+	bounds, err := chunkBoundaries(r, size, n)
+	if err != nil {
+		return nil, err
+	}
+
+	matcher := newLineMatcher(searchString)
+	results := make([]chunkResult, len(bounds)-1)
+	bytesRead := make([]int64, len(bounds)-1)
+
+	var wg sync.WaitGroup
+	for i := range results {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			counter := &countingReader{r: io.NewSectionReader(r, bounds[i], bounds[i+1]-bounds[i])}
+			results[i] = scanLines(ctx, bufio.NewScanner(counter), matcher)
+			bytesRead[i] = counter.n
+		}(i)
+	}
+	wg.Wait()
+
+	var lines, total int64
+	var count int
+	for i, result := range results {
+		lines += result.lines
+		total += bytesRead[i]
+		count += result.count
+	}
+	recordStats(lines, total, count)
+
+	return mergeChunks(results)
+}
+
+// chunkBoundaries splits [0, size) into at most n ranges that each start at
+// the beginning of a line. The result holds the start of every range
+// followed by size.
+func chunkBoundaries(r io.ReaderAt, size int64, n int) ([]int64, error) {
+	bounds := []int64{0}
+	buf := make([]byte, 64<<10)
+
+	for i := 1; i < n; i++ {
+		pos := size * int64(i) / int64(n)
+		if pos <= bounds[len(bounds)-1] {
+			continue
+		}
+
+		start, err := nextLineStart(r, pos, size, buf)
+		if err != nil {
+			return nil, err
+		}
+		if start >= size {
+			break
+		}
+		if start > bounds[len(bounds)-1] {
+			bounds = append(bounds, start)
+		}
+	}
+
+	return append(bounds, size), nil
+}
+
+// nextLineStart returns the first line start at or after pos.
+func nextLineStart(r io.ReaderAt, pos, size int64, buf []byte) (int64, error) {
+	// pos is already a line start if the byte before it is a newline
+	for offset := pos - 1; offset < size; {
+		n, err := r.ReadAt(buf, offset)
+		index := bytes.IndexByte(buf[:n], '\n')
+		if index >= 0 {
+			return offset + int64(index) + 1, nil
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return 0, err
+		}
+		offset += int64(n)
+	}
+	return size, nil
+}
+
+// lineSource yields input one line at a time. bufio.Scanner is one;
+// mappedLines reads a memory-mapped file without copying it.
+type lineSource interface {
+	Scan() bool
+	Text() string
+	Err() error
+}
+
+// scanLines reads lines one by one, keeping the matches, their context
+// lines, and the lines at either end that could be context for a match in a
+// neighbouring chunk. mergeChunks decides which of them are printed.
+func scanLines(ctx context.Context, scanner lineSource, matcher *lineMatcher) chunkResult {
+	var result chunkResult
+
+	// mapped lines alias the mapping, so copy any that are kept
+	_, mapped := scanner.(*mappedLines)
+	keep := func(record lineRecord) lineRecord {
+		if mapped {
+			record.text = strings.Clone(record.text)
+		}
+		return record
+	}
+	// context lines are projected with --fields only once they are sure to
+	// be kept, rather than as every line passes through pending
+	project := func(records ...lineRecord) []lineRecord {
+		if len(outputFields) > 0 {
+			for i := range records {
+				records[i].text = projectLine(records[i].text)
+			}
+		}
+		return records
+	}
+
+	pending := make([]lineRecord, 0, before)
+	afterRemaining := 0
+
+	for scanner.Scan() {
+		if err := ctx.Err(); err != nil {
+			result.err = err
+			break
+		}
+		result.lines++
+
+		line := scanner.Text()
+		matched, prefix, text, err := matcher.match(line)
+		if err != nil {
+			result.err = err
+			result.errLine = result.lines
+			return result
+		}
+
+		if matched {
+			result.count++
+			if groupKey != nil {
+				if result.groups == nil {
+					result.groups = make(map[string]int)
+				}
+				result.groups[strings.Clone(groupKey.key(line))]++
+			}
+		}
+		if countOnly || groupKey != nil {
+			continue
+		}
+
+		record := lineRecord{number: result.lines, text: text}
+
+		if matched {
+			record.match = true
+			record.prefix = prefix
+			result.records = append(result.records, project(pending...)...)
+			pending = pending[:0]
+			result.records = append(result.records, keep(record))
+			afterRemaining = after
+
+		} else if afterRemaining > 0 || result.lines <= int64(after) {
+			result.records = append(result.records, project(keep(record))...)
+			if afterRemaining > 0 {
+				afterRemaining--
+			}
+
+		} else if before > 0 {
+			if len(pending) == before {
+				pending = pending[1:]
+			}
+			pending = append(pending, keep(record))
+		}
+	}
+
+	err := scanner.Err()
+	if err != nil {
+		result.err = err
+		return result
+	}
+
+	result.records = append(result.records, project(pending...)...)
+	return result
+}
+
+// mergeChunks renumbers the records of consecutive chunks, keeps the matches
+// and the lines within -B/-A of one, and formats them for output.
+func mergeChunks(results []chunkResult) ([]string, error) {
+	var records []lineRecord
+	var offset int64
+	var count int
+	var ctxErr error
+
+	for _, result := range results {
+		if result.err != nil && !isCanceled(result.err) {
+			if result.errLine > 0 {
+				return nil, fmt.Errorf("line %d: %v", offset+result.errLine, result.err)
+			}
+			return nil, result.err
+		}
+
+		for _, record := range result.records {
+			record.number += offset
+			records = append(records, record)
+		}
+		offset += result.lines
+		count += result.count
+		groups.add(result.groups)
+
+		// later chunks are not contiguous with a cancelled one
+		if result.err != nil {
+			ctxErr = result.err
+			break
+		}
+	}
+
+	// --count-by prints one table for the whole run instead
+	if groupKey != nil {
+		return nil, ctxErr
+	}
+	if countOnly {
+		return []string{strconv.Itoa(count)}, ctxErr
+	}
+
+	keep := make([]bool, len(records))
+	lastMatch := int64(math.MinInt64 / 2)
+	for i, record := range records {
+		if record.match {
+			lastMatch = record.number
+			keep[i] = true
+		} else if record.number-lastMatch <= int64(after) {
+			keep[i] = true
+		}
+	}
+	nextMatch := int64(math.MaxInt64 / 2)
+	for i := len(records) - 1; i >= 0; i-- {
+		if records[i].match {
+			nextMatch = records[i].number
+		} else if nextMatch-records[i].number <= int64(before) {
+			keep[i] = true
+		}
+	}
+
+	var matches []string
+	for i, record := range records {
+		if keep[i] {
+			matches = append(matches, formatRecord(record))
+		}
+	}
+	return matches, ctxErr
+}
+
+// formatRecord renders a line for output. With -n, matches are numbered
+// "N:" and context lines "N-", as in grep.
+func formatRecord(record lineRecord) string {
+	if !lineNumbers {
+		return record.prefix + record.text
+	}
+
+	separator := "-"
+	if record.match {
+		separator = ":"
+	}
+	return strconv.FormatInt(record.number, 10) + separator + record.prefix + record.text
+}
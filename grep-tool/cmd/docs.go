@@ -0,0 +1,71 @@
+package cmd
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/cobra/doc"
+)
+
+var completionCmd = &cobra.Command{
+	Use:   "completion bash|zsh|fish|powershell",
+	Short: "Generate a shell completion script",
+	Long: `Generate a completion script for mygrep and print it to stdout.
+
+To load completions for the current bash session:
+
+	source <(mygrep completion bash)
+
+For zsh, fish and PowerShell, write the script to a file your shell loads
+at startup.`,
+	Args:      cobra.MatchAll(cobra.ExactArgs(1), cobra.OnlyValidArgs),
+	ValidArgs: []string{"bash", "zsh", "fish", "powershell"},
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return writeCompletion(cmd.OutOrStdout(), args[0])
+	},
+}
+
+var manCmd = &cobra.Command{
+	Use:   "man",
+	Short: "Generate the mygrep man page",
+	Long: `Generate a roff man page for mygrep from its flags and print it to stdout,
+for example:
+
+	mygrep man > /usr/local/share/man/man1/mygrep.1`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return writeManPage(cmd.OutOrStdout())
+	},
+}
+
+func init() {
+	rootCmd.CompletionOptions.DisableDefaultCmd = true
+	rootCmd.AddCommand(completionCmd, manCmd)
+}
+
+func writeCompletion(w io.Writer, shell string) error {
+	switch shell {
+	case "bash":
+		return rootCmd.GenBashCompletionV2(w, true)
+	case "zsh":
+		return rootCmd.GenZshCompletion(w)
+	case "fish":
+		return rootCmd.GenFishCompletion(w, true)
+	case "powershell":
+		return rootCmd.GenPowerShellCompletionWithDesc(w)
+	}
+	return fmt.Errorf("unsupported shell %q", shell)
+}
+
+// writeManPage renders the root command's man page. The date in the header
+// honours SOURCE_DATE_EPOCH for reproducible output.
+func writeManPage(w io.Writer) error {
+	header := &doc.GenManHeader{
+		Title:   "MYGREP",
+		Section: "1",
+		Source:  "mygrep",
+		Manual:  "User Commands",
+	}
+	return doc.GenMan(rootCmd, header, w)
+}
@@ -0,0 +1,16 @@
+//go:build !unix
+
+package cmd
+
+import "io/fs"
+
+// fileID identifies a file independently of the path used to reach it.
+type fileID struct {
+	dev, ino uint64
+}
+
+// fileIDOf has no portable device/inode source here, so loop detection and
+// --one-file-system are disabled on these platforms.
+func fileIDOf(info fs.FileInfo) (fileID, bool) {
+	return fileID{}, false
+}
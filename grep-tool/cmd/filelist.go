@@ -0,0 +1,96 @@
+package cmd
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// loadFileList reads the paths named by --files-from or --files0-from.
+// A name of "-" reads the list from stdin.
+func loadFileList() ([]string, error) {
+	name, separator := filesFrom, byte('\n')
+	if files0From != "" {
+		name, separator = files0From, 0
+	}
+
+	if name == "-" {
+		return readFileList(os.Stdin, separator)
+	}
+
+	file, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	return readFileList(file, separator)
+}
+
+// readFileList splits r on separator, dropping empty entries. With a newline
+// separator a trailing carriage return is removed as well.
+func readFileList(r io.Reader, separator byte) ([]string, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1<<20)
+	scanner.Split(func(data []byte, atEOF bool) (int, []byte, error) {
+		index := bytes.IndexByte(data, separator)
+		if index >= 0 {
+			return index + 1, data[:index], nil
+		}
+		if atEOF && len(data) > 0 {
+			return len(data), data, nil
+		}
+		return 0, nil, nil
+	})
+
+	var paths []string
+	for scanner.Scan() {
+		path := scanner.Text()
+		if separator == '\n' {
+			path = strings.TrimSuffix(path, "\r")
+		}
+		if path != "" {
+			paths = append(paths, path)
+		}
+	}
+
+	err := scanner.Err()
+	if err != nil {
+		return nil, err
+	}
+	return paths, nil
+}
+
+// searchFileList greps each path in order, prefixing matches with the file
+// name. Files that cannot be read are reported and skipped; ok is false if
+// there were any.
+func searchFileList(ctx context.Context, searchString string, paths []string, out io.Writer) (ok bool, err error) {
+	ok = true
+	writer := &resultWriter{out: out}
+	for _, path := range paths {
+		file, err := validateFile(path)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			ok = false
+			continue
+		}
+
+		matches, err := grepFile(ctx, searchString, file)
+		file.Close()
+		if err != nil && !isCanceled(err) {
+			fmt.Fprintf(os.Stderr, "%s: %s: %v\n", os.Args[0], path, err)
+			ok = false
+			continue
+		}
+
+		writer.write(path, matches)
+		if err != nil {
+			return ok, err
+		}
+	}
+	return ok, nil
+}
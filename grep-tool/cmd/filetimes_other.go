@@ -0,0 +1,18 @@
+//go:build !linux
+
+package cmd
+
+import (
+	"io/fs"
+	"time"
+)
+
+// accessTime and birthTime are only implemented on Linux; elsewhere files
+// sorted by them keep path order.
+func accessTime(info fs.FileInfo) (time.Time, bool) {
+	return time.Time{}, false
+}
+
+func birthTime(path string) (time.Time, bool) {
+	return time.Time{}, false
+}
@@ -0,0 +1,129 @@
+package cmd
+
+import (
+	"fmt"
+	"io/fs"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// byteSize is a flag value accepting sizes like 512, 10K, 20M or 1G.
+// Suffixes are binary multiples. A negative value means no limit.
+type byteSize int64
+
+func (b *byteSize) Set(s string) error {
+	size, err := parseByteSize(s)
+	if err != nil {
+		return err
+	}
+	*b = byteSize(size)
+	return nil
+}
+
+func (b *byteSize) String() string {
+	if *b < 0 {
+		return ""
+	}
+	return strconv.FormatInt(int64(*b), 10)
+}
+
+func (b *byteSize) Type() string {
+	return "size"
+}
+
+func parseByteSize(s string) (int64, error) {
+	multipliers := map[string]int64{
+		"":  1,
+		"K": 1 << 10,
+		"M": 1 << 20,
+		"G": 1 << 30,
+		"T": 1 << 40,
+	}
+
+	number := strings.TrimRight(strings.ToUpper(s), "B")
+	unit := ""
+	if number != "" {
+		last := number[len(number)-1:]
+		if _, ok := multipliers[last]; ok {
+			unit = last
+			number = number[:len(number)-1]
+		}
+	}
+
+	// a size that overflows would wrap to a negative one, meaning no limit
+	n, err := strconv.ParseInt(number, 10, 64)
+	if err != nil || n < 0 || n > math.MaxInt64/multipliers[unit] {
+		return 0, fmt.Errorf("invalid size %q: want a number with an optional K, M, G or T suffix", s)
+	}
+	return n * multipliers[unit], nil
+}
+
+// newerThan is a flag value holding a modification-time cutoff. It accepts a
+// duration relative to now (1h, 30m) or an absolute date.
+type newerThan struct {
+	cutoff time.Time
+	raw    string
+}
+
+var dateLayouts = []string{
+	time.RFC3339,
+	"2006-01-02T15:04:05",
+	"2006-01-02 15:04:05",
+	"2006-01-02 15:04",
+	"2006-01-02",
+}
+
+func (n *newerThan) Set(s string) error {
+	d, err := time.ParseDuration(s)
+	if err == nil {
+		n.cutoff = time.Now().Add(-d)
+		n.raw = s
+		return nil
+	}
+
+	for _, layout := range dateLayouts {
+		t, err := time.ParseInLocation(layout, s, time.Local)
+		if err == nil {
+			n.cutoff = t
+			n.raw = s
+			return nil
+		}
+	}
+
+	return fmt.Errorf("invalid time %q: want a duration like 1h or a date like 2006-01-02", s)
+}
+
+func (n *newerThan) String() string {
+	return n.raw
+}
+
+func (n *newerThan) Type() string {
+	return "duration|date"
+}
+
+// allowsFileInfo applies --newer-than, --min-filesize and --max-filesize to a
+// file's metadata, so rejected files are never opened.
+func allowsFileInfo(info fs.FileInfo) bool {
+	return fileInfoSkipReason(info) == ""
+}
+
+// fileInfoSkipReason explains why allowsFileInfo rejects info, or returns ""
+// if it doesn't.
+func fileInfoSkipReason(info fs.FileInfo) string {
+	if !newerThanFlag.cutoff.IsZero() && info.ModTime().Before(newerThanFlag.cutoff) {
+		return fmt.Sprintf("modified %s, before --newer-than", info.ModTime().Format(time.RFC3339))
+	}
+	if minFileSize >= 0 && info.Size() < int64(minFileSize) {
+		return fmt.Sprintf("%d bytes, smaller than --min-filesize %d", info.Size(), int64(minFileSize))
+	}
+	if maxFileSize >= 0 && info.Size() > int64(maxFileSize) {
+		return fmt.Sprintf("%d bytes, larger than --max-filesize %d", info.Size(), int64(maxFileSize))
+	}
+	return ""
+}
+
+func hasFileInfoFilters() bool {
+	return !newerThanFlag.cutoff.IsZero() || minFileSize >= 0 || maxFileSize >= 0
+}
@@ -0,0 +1,169 @@
+package cmd
+
+// fuzzyMatch is an approximate occurrence of the pattern in a line. Offsets
+// count runes and end is exclusive.
+type fuzzyMatch struct {
+	start, end int
+	distance   int
+}
+
+// fuzzyMatcher finds substrings within a Levenshtein distance of a pattern.
+// Patterns of up to 64 runes use the bit-parallel Wu-Manber (bitap) algorithm;
+// longer ones fall back to Sellers' dynamic programming.
+type fuzzyMatcher struct {
+	pattern []rune
+	maxDist int
+	masks   map[rune]uint64
+}
+
+func newFuzzyMatcher(pattern string, maxDist int) *fuzzyMatcher {
+	m := &fuzzyMatcher{pattern: []rune(pattern), maxDist: maxDist}
+	if len(m.pattern) <= 64 {
+		m.masks = make(map[rune]uint64)
+		for i, r := range m.pattern {
+			m.masks[r] |= 1 << i
+		}
+	}
+	return m
+}
+
+// find returns the best match in line: the lowest distance, and of those the
+// one that ends first.
+func (m *fuzzyMatcher) find(line string) (fuzzyMatch, bool) {
+	text := []rune(line)
+
+	var end, distance int
+	var ok bool
+	if m.masks != nil {
+		end, distance, ok = m.bitapEnd(text)
+	} else {
+		end, distance, ok = m.sellersEnd(text)
+	}
+	if !ok {
+		return fuzzyMatch{}, false
+	}
+
+	return fuzzyMatch{start: end - m.spanLength(text[:end], distance), end: end, distance: distance}, true
+}
+
+// bitapEnd runs Wu-Manber bitap with maxDist errors. Bit i of state[d] is
+// set when pattern[:i+1] matches a suffix of the text read so far with at
+// most d edits.
+func (m *fuzzyMatcher) bitapEnd(text []rune) (end, distance int, ok bool) {
+	patternLen := len(m.pattern)
+	if patternLen == 0 {
+		return 0, 0, true
+	}
+	found := uint64(1) << (patternLen - 1)
+
+	state := make([]uint64, m.maxDist+1)
+	for d := range state {
+		// a prefix of up to d pattern runes can be deleted before any text
+		if d >= 64 {
+			state[d] = ^uint64(0)
+		} else {
+			state[d] = uint64(1)<<d - 1
+		}
+	}
+
+	bestEnd, bestDist := 0, m.maxDist+1
+	check := func(pos int) {
+		for d := 0; d < bestDist; d++ {
+			if state[d]&found != 0 {
+				bestEnd, bestDist = pos, d
+				return
+			}
+		}
+	}
+
+	check(0)
+	for i, r := range text {
+		mask := m.masks[r]
+		previous := state[0]
+		state[0] = (state[0]<<1 | 1) & mask
+		for d := 1; d <= m.maxDist; d++ {
+			current := state[d]
+			state[d] = (current<<1|1)&mask | // match
+				previous | // extra text rune
+				(previous<<1 | 1) | // substitution
+				(state[d-1]<<1 | 1) // missing pattern rune
+			previous = current
+		}
+		check(i + 1)
+		if bestDist == 0 {
+			break
+		}
+	}
+
+	if bestDist > m.maxDist {
+		return 0, 0, false
+	}
+	return bestEnd, bestDist, true
+}
+
+// sellersEnd is the dynamic-programming equivalent of bitapEnd, used for
+// patterns too long to fit in a machine word.
+func (m *fuzzyMatcher) sellersEnd(text []rune) (end, distance int, ok bool) {
+	patternLen := len(m.pattern)
+	column := make([]int, patternLen+1)
+	for i := range column {
+		column[i] = i
+	}
+
+	bestEnd, bestDist := 0, column[patternLen]
+	for j, r := range text {
+		diagonal := column[0]
+		for i := 1; i <= patternLen; i++ {
+			cost := 1
+			if m.pattern[i-1] == r {
+				cost = 0
+			}
+			next := min(diagonal+cost, column[i]+1, column[i-1]+1)
+			diagonal = column[i]
+			column[i] = next
+		}
+		if column[patternLen] < bestDist {
+			bestEnd, bestDist = j+1, column[patternLen]
+		}
+	}
+
+	if bestDist > m.maxDist {
+		return 0, 0, false
+	}
+	return bestEnd, bestDist, true
+}
+
+// spanLength returns the length of the shortest suffix of text that is
+// within distance edits of the whole pattern.
+func (m *fuzzyMatcher) spanLength(text []rune, distance int) int {
+	patternLen := len(m.pattern)
+	window := min(len(text), patternLen+distance)
+
+	// row[j] is the edit distance between the pattern read backwards and the
+	// last j runes of text read backwards
+	row := make([]int, window+1)
+	for j := range row {
+		row[j] = j
+	}
+	for i := 1; i <= patternLen; i++ {
+		p := m.pattern[patternLen-i]
+		diagonal := row[0]
+		row[0] = i
+		for j := 1; j <= window; j++ {
+			cost := 1
+			if text[len(text)-j] == p {
+				cost = 0
+			}
+			next := min(diagonal+cost, row[j]+1, row[j-1]+1)
+			diagonal = row[j]
+			row[j] = next
+		}
+	}
+
+	for j, d := range row {
+		if d <= distance {
+			return j
+		}
+	}
+	return window
+}
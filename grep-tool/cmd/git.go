@@ -0,0 +1,224 @@
+package cmd
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+var gitChangedBase string
+var gitRev string
+
+// changedFiles is built from --git-changed in Run and consulted by
+// walkSearchFiles and gitRevSearch.
+var changedFiles *gitChangedFilter
+
+// gitChangedFilter allows only the files "git diff --name-only BASE" lists.
+type gitChangedFilter struct {
+	root         string // the search root as given
+	resolvedRoot string // the search root, absolute with symlinks resolved
+	toplevel     string // the repository's working tree root
+	files        map[string]bool
+}
+
+// runGit runs git in dir and returns its stdout, turning a failure into an
+// error carrying git's own message.
+func runGit(ctx context.Context, dir string, args ...string) ([]byte, error) {
+	cmd := exec.CommandContext(ctx, "git", args...)
+	cmd.Dir = dir
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+
+	out, err := cmd.Output()
+	if err != nil {
+		if message := firstLine(stderr.String()); message != "" {
+			return nil, fmt.Errorf("git %s: %s", args[0], message)
+		}
+		return nil, fmt.Errorf("git %s: %v", args[0], err)
+	}
+	return out, nil
+}
+
+// gitDir returns the directory to run git in for root, and the pathspec
+// that selects root from there.
+func gitDir(root string) (dir, pathspec string) {
+	info, err := os.Stat(root)
+	if err == nil && info.IsDir() {
+		return root, "."
+	}
+	return filepath.Dir(root), filepath.Base(root)
+}
+
+func newGitChangedFilter(ctx context.Context, root, base string) (*gitChangedFilter, error) {
+	dir, _ := gitDir(root)
+	top, err := runGit(ctx, dir, "rev-parse", "--show-toplevel")
+	if err != nil {
+		return nil, err
+	}
+	// deleted files can't be searched, so leave them out
+	names, err := runGit(ctx, dir, "diff", "--name-only", "-z", "--diff-filter=d", base, "--")
+	if err != nil {
+		return nil, err
+	}
+
+	resolvedRoot, err := filepath.Abs(root)
+	if err == nil {
+		resolvedRoot, err = filepath.EvalSymlinks(resolvedRoot)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	f := &gitChangedFilter{
+		root:         root,
+		resolvedRoot: resolvedRoot,
+		toplevel:     filepath.FromSlash(strings.TrimSpace(string(top))),
+		files:        make(map[string]bool),
+	}
+	for _, name := range strings.Split(string(names), "\x00") {
+		if name != "" {
+			f.files[name] = true
+		}
+	}
+	return f, nil
+}
+
+// allows reports whether path, found by walking the search root, is one of
+// the changed files.
+func (f *gitChangedFilter) allows(path string) bool {
+	if f == nil {
+		return true
+	}
+	rel, err := filepath.Rel(f.root, path)
+	if err != nil {
+		return false
+	}
+	name, err := filepath.Rel(f.toplevel, filepath.Join(f.resolvedRoot, rel))
+	return err == nil && f.files[filepath.ToSlash(name)]
+}
+
+// allowsName is allows for a path relative to the top of the repository.
+func (f *gitChangedFilter) allowsName(name string) bool {
+	return f == nil || f.files[name]
+}
+
+// gitRevSearch greps the files under root as they were at rev, reading the
+// blobs from a single "git cat-file --batch". Matches are labelled REV:path,
+// with path relative to the top of the repository.
+func gitRevSearch(ctx context.Context, searchString, rev, root string, out io.Writer) error {
+	dir, pathspec := gitDir(root)
+	list, err := runGit(ctx, dir, "ls-tree", "-r", "-z", "--full-name", "--name-only", rev, "--", pathspec)
+	if err != nil {
+		return err
+	}
+
+	var names []string
+	for _, name := range strings.Split(string(list), "\x00") {
+		// cat-file --batch reads one object name per line
+		if name == "" || strings.Contains(name, "\n") {
+			continue
+		}
+		if typeFilter.allows(name) && changedFiles.allowsName(name) {
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 {
+		return nil
+	}
+
+	// stopping early must not leave cat-file blocked on a full pipe
+	batchCtx, cancel := context.WithCancel(ctx)
+	cmd := exec.CommandContext(batchCtx, "git", "cat-file", "--batch")
+	cmd.Dir = dir
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		cancel()
+		return err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		cancel()
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		cancel()
+		return err
+	}
+	defer func() {
+		cancel()
+		cmd.Wait()
+	}()
+
+	go func() {
+		defer stdin.Close()
+		for _, name := range names {
+			if _, err := fmt.Fprintf(stdin, "%s:%s\n", rev, name); err != nil {
+				return
+			}
+		}
+	}()
+
+	reader := bufio.NewReader(stdout)
+	writer := &resultWriter{out: out}
+	for _, name := range names {
+		content, err := readBatchBlob(reader)
+		if err != nil {
+			if ctxErr := ctx.Err(); ctxErr != nil {
+				return ctxErr
+			}
+			return fmt.Errorf("git cat-file: %s: %v", name, err)
+		}
+		if content == nil {
+			continue
+		}
+
+		matches, err := grepReader(ctx, searchString, bytes.NewReader(content))
+		if err != nil && !isCanceled(err) {
+			fmt.Fprintf(os.Stderr, "%s: %s:%s: %v\n", os.Args[0], rev, name, err)
+			continue
+		}
+		writer.write(rev+":"+name, matches)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readBatchBlob reads one "git cat-file --batch" response. It returns nil
+// content for objects that are missing or are not blobs, such as submodules.
+func readBatchBlob(reader *bufio.Reader) ([]byte, error) {
+	header, err := reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+
+	// "<oid> <type> <size>" or "<name> missing"
+	fields := strings.Fields(header)
+	if len(fields) != 3 || fields[2] == "missing" {
+		return nil, nil
+	}
+	size, err := strconv.ParseInt(fields[2], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("unexpected header %q", strings.TrimSpace(header))
+	}
+
+	content := make([]byte, size)
+	if _, err := io.ReadFull(reader, content); err != nil {
+		return nil, err
+	}
+	if _, err := reader.Discard(1); err != nil {
+		return nil, err
+	}
+	if fields[1] != "blob" {
+		return nil, nil
+	}
+	return content, nil
+}
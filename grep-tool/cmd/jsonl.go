@@ -0,0 +1,180 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Policies for lines that are not JSON objects when --jsonl-field is used.
+const (
+	invalidJSONSkip  = "skip"
+	invalidJSONRaw   = "raw"
+	invalidJSONError = "error"
+)
+
+// fieldPattern is one --jsonl-field PATH=PATTERN condition.
+type fieldPattern struct {
+	path    []string
+	pattern string
+}
+
+func parseFieldPatterns(specs []string) ([]fieldPattern, error) {
+	var patterns []fieldPattern
+	for _, spec := range specs {
+		path, pattern, ok := strings.Cut(spec, "=")
+		if !ok || path == "" {
+			return nil, fmt.Errorf("invalid --jsonl-field %q: want PATH=PATTERN", spec)
+		}
+		patterns = append(patterns, fieldPattern{path: strings.Split(path, "."), pattern: pattern})
+	}
+	return patterns, nil
+}
+
+func parseFieldList(list string) [][]string {
+	var fields [][]string
+	for _, field := range strings.Split(list, ",") {
+		field = strings.TrimSpace(field)
+		if field != "" {
+			fields = append(fields, strings.Split(field, "."))
+		}
+	}
+	return fields
+}
+
+func validInvalidJSONPolicy(policy string) bool {
+	return policy == invalidJSONSkip || policy == invalidJSONRaw || policy == invalidJSONError
+}
+
+// parseJSONObject decodes line if it is a single JSON object. Numbers are
+// kept as json.Number so they print exactly as they appeared.
+func parseJSONObject(line string) (map[string]any, bool) {
+	decoder := json.NewDecoder(strings.NewReader(line))
+	decoder.UseNumber()
+
+	var object map[string]any
+	err := decoder.Decode(&object)
+	if err != nil || object == nil || decoder.More() {
+		return nil, false
+	}
+	return object, true
+}
+
+// lookupField follows a dotted path through nested objects and arrays.
+func lookupField(value any, path []string) (any, bool) {
+	for _, key := range path {
+		switch v := value.(type) {
+		case map[string]any:
+			next, ok := v[key]
+			if !ok {
+				return nil, false
+			}
+			value = next
+		case []any:
+			index, err := strconv.Atoi(key)
+			if err != nil || index < 0 || index >= len(v) {
+				return nil, false
+			}
+			value = v[index]
+		default:
+			return nil, false
+		}
+	}
+	return value, true
+}
+
+func fieldString(value any) string {
+	switch v := value.(type) {
+	case string:
+		return v
+	case json.Number:
+		return v.String()
+	case bool:
+		return strconv.FormatBool(v)
+	case nil:
+		return "null"
+	}
+
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	encoder.SetEscapeHTML(false)
+	encoder.Encode(value)
+	return strings.TrimSuffix(buf.String(), "\n")
+}
+
+// matchJSONLine applies every --jsonl-field condition to line, already
+// decoded into object by parseJSONObject. A nil object means line is not a
+// JSON object, which is handled according to --jsonl-invalid.
+func matchJSONLine(line string, object map[string]any) (bool, error) {
+	if object == nil {
+		switch jsonlInvalid {
+		case invalidJSONError:
+			return false, fmt.Errorf("line is not a JSON object: %q", line)
+		case invalidJSONRaw:
+			return matchRawLine(line), nil
+		default:
+			return false, nil
+		}
+	}
+
+	for _, condition := range fieldPatterns {
+		value, ok := lookupField(object, condition.path)
+		if !ok {
+			return false, nil
+		}
+		if !containsFold(fieldString(value), condition.pattern) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// matchRawLine is the --jsonl-invalid=raw fallback: every pattern must occur
+// somewhere in the unparsed line.
+func matchRawLine(line string) bool {
+	for _, condition := range fieldPatterns {
+		if !containsFold(line, condition.pattern) {
+			return false
+		}
+	}
+	return true
+}
+
+func containsFold(s, substr string) bool {
+	if caseInsensitive {
+		return strings.Contains(strings.ToLower(s), strings.ToLower(substr))
+	}
+	return strings.Contains(s, substr)
+}
+
+// projectLine decodes line and renders its --fields selection. It is for
+// lines that were not already decoded to be matched, such as context lines.
+func projectLine(line string) string {
+	object, _ := parseJSONObject(line)
+	return projectFields(line, object)
+}
+
+// projectFields renders the --fields selection of line, already decoded into
+// object, as space-separated key=value pairs. Missing fields are left out and
+// lines that are not JSON objects (a nil object) are returned unchanged.
+func projectFields(line string, object map[string]any) string {
+	if object == nil {
+		return line
+	}
+
+	var parts []string
+	for _, path := range outputFields {
+		value, ok := lookupField(object, path)
+		if !ok {
+			continue
+		}
+		s := fieldString(value)
+		if s == "" || strings.ContainsAny(s, " \t\"=") {
+			s = strconv.Quote(s)
+		}
+		parts = append(parts, strings.Join(path, ".")+"="+s)
+	}
+	return strings.Join(parts, " ")
+}
@@ -0,0 +1,160 @@
+package cmd
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	runtimedebug "runtime/debug"
+	"sync"
+	"unsafe"
+)
+
+var forceMmap, noMmap bool
+
+// mmapThreshold is the size from which a regular file is searched through a
+// memory mapping rather than read into a buffer, unless --mmap or --no-mmap
+// say otherwise.
+var mmapThreshold int64 = 4 << 20
+
+// errMapFailed means a file could not be searched through a mapping and
+// should be read instead: mapping it failed, or it shrank while mapped.
+var errMapFailed = errors.New("file could not be searched through mmap")
+
+// useMmap reports whether the file described by info should be mapped.
+// Pipes, devices and empty files never are.
+func useMmap(info fs.FileInfo) bool {
+	if !mmapSupported || noMmap || !info.Mode().IsRegular() || info.Size() == 0 {
+		return false
+	}
+	return forceMmap || info.Size() >= mmapThreshold
+}
+
+// grepMapped searches the first size bytes of file through a read-only
+// mapping, split into workers chunks when it is large enough. It returns
+// errMapFailed, without recording any stats, if the caller should read the
+// file instead.
+func grepMapped(ctx context.Context, searchString string, file *os.File, size int64, workers int) ([]string, error) {
+	data, err := mmapFile(file, size)
+	if err != nil {
+		if debug {
+			fmt.Fprintf(os.Stderr, "%s: debug: %s: mmap: %v, reading it instead\n", os.Args[0], file.Name(), err)
+		}
+		return nil, errMapFailed
+	}
+	defer munmapFile(data)
+
+	n := 1
+	if size >= parallelChunkThreshold && workers >= 2 {
+		n = workers
+	}
+	matches, err := searchMapping(ctx, searchString, data, n)
+	if errors.Is(err, errMapFailed) && debug {
+		fmt.Fprintf(os.Stderr, "%s: debug: %s: changed while mapped, reading it instead\n", os.Args[0], file.Name())
+	}
+	return matches, err
+}
+
+// searchMapping searches mapped file contents in n newline-aligned chunks.
+// A fault while reading the mapping is reported as errMapFailed.
+func searchMapping(ctx context.Context, searchString string, data []byte, n int) ([]string, error) {
+	var bounds []int64
+	err := catchFault(func() {
+		bounds, _ = chunkBoundaries(bytes.NewReader(data), int64(len(data)), n)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	matcher := newLineMatcher(searchString)
+	results := make([]chunkResult, len(bounds)-1)
+	faults := make([]error, len(results))
+
+	var wg sync.WaitGroup
+	for i := range results {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			faults[i] = catchFault(func() {
+				lines := &mappedLines{data: data[bounds[i]:bounds[i+1]]}
+				results[i] = scanLines(ctx, lines, matcher)
+			})
+		}(i)
+	}
+	wg.Wait()
+
+	if err := errors.Join(faults...); err != nil {
+		return nil, errMapFailed
+	}
+
+	var lines int64
+	var count int
+	for _, result := range results {
+		lines += result.lines
+		count += result.count
+	}
+	recordStats(lines, int64(len(data)), count)
+
+	return mergeChunks(results)
+}
+
+// catchFault runs fn, turning a memory fault into errMapFailed. Reading a
+// mapped page past the end of a file that was truncated raises SIGBUS,
+// which would otherwise kill the process.
+func catchFault(fn func()) (err error) {
+	defer runtimedebug.SetPanicOnFault(runtimedebug.SetPanicOnFault(true))
+	defer func() {
+		if r := recover(); r != nil {
+			if _, ok := r.(interface{ Addr() uintptr }); ok {
+				err = errMapFailed
+				return
+			}
+			panic(r)
+		}
+	}()
+
+	fn()
+	return nil
+}
+
+// mappedLines is a lineSource over mapped file contents. Like bufio.Scanner
+// it strips "\n" and a preceding "\r" and stops with bufio.ErrTooLong at a
+// line that would not fit in its default buffer, so both paths search the
+// same lines. Text returns strings that alias the mapping, so they must be
+// copied to outlive it.
+type mappedLines struct {
+	data []byte
+	line string
+	err  error
+}
+
+func (m *mappedLines) Scan() bool {
+	if len(m.data) == 0 || m.err != nil {
+		return false
+	}
+
+	var line []byte
+	if i := bytes.IndexByte(m.data, '\n'); i >= 0 {
+		line, m.data = m.data[:i], m.data[i+1:]
+	} else {
+		line, m.data = m.data, nil
+	}
+	if len(line) >= bufio.MaxScanTokenSize {
+		m.err = bufio.ErrTooLong
+		return false
+	}
+	line = bytes.TrimSuffix(line, []byte{'\r'})
+	m.line = unsafe.String(unsafe.SliceData(line), len(line))
+	return true
+}
+
+func (m *mappedLines) Text() string {
+	return m.line
+}
+
+func (m *mappedLines) Err() error {
+	return m.err
+}
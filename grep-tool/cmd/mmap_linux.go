@@ -0,0 +1,29 @@
+//go:build linux
+
+package cmd
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+const mmapSupported = true
+
+// mmapFile maps the first size bytes of file read-only.
+func mmapFile(file *os.File, size int64) ([]byte, error) {
+	if int64(int(size)) != size {
+		return nil, errMapFailed
+	}
+	data, err := unix.Mmap(int(file.Fd()), 0, int(size), unix.PROT_READ, unix.MAP_SHARED)
+	if err != nil {
+		return nil, err
+	}
+	// the kernel can read ahead more aggressively for a front-to-back scan
+	unix.Madvise(data, unix.MADV_SEQUENTIAL)
+	return data, nil
+}
+
+func munmapFile(data []byte) error {
+	return unix.Munmap(data)
+}
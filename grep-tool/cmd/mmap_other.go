@@ -0,0 +1,19 @@
+//go:build !linux
+
+package cmd
+
+import (
+	"errors"
+	"os"
+)
+
+// mmap is only used on Linux; elsewhere files are always read.
+const mmapSupported = false
+
+func mmapFile(file *os.File, size int64) ([]byte, error) {
+	return nil, errors.ErrUnsupported
+}
+
+func munmapFile(data []byte) error {
+	return nil
+}
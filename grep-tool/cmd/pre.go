@@ -0,0 +1,93 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+var preCommand string
+var preGlobs []string
+var preTimeout time.Duration
+
+// usePreprocessor reports whether path is searched through --pre: always
+// when no --pre-glob is given, otherwise when its base name matches one.
+// A glob starting with ! excludes the files it matches.
+func usePreprocessor(path string) bool {
+	if preCommand == "" {
+		return false
+	}
+	if len(preGlobs) == 0 {
+		return true
+	}
+
+	base := filepath.Base(path)
+	var include, exclude []string
+	for _, glob := range preGlobs {
+		if strings.HasPrefix(glob, "!") {
+			exclude = append(exclude, strings.TrimPrefix(glob, "!"))
+		} else {
+			include = append(include, glob)
+		}
+	}
+	if matchesAnyGlob(base, exclude) {
+		return false
+	}
+	return len(include) == 0 || matchesAnyGlob(base, include)
+}
+
+// grepPreprocessed runs "--pre COMMAND PATH" with the file on its stdin and
+// searches what it writes to stdout. A converter that fails or runs longer
+// than --pre-timeout is reported as an error for this file only.
+func grepPreprocessed(ctx context.Context, searchString string, file *os.File) ([]string, error) {
+	preCtx := ctx
+	if preTimeout > 0 {
+		var cancel context.CancelFunc
+		preCtx, cancel = context.WithTimeout(ctx, preTimeout)
+		defer cancel()
+	}
+
+	cmd := exec.CommandContext(preCtx, preCommand, file.Name())
+	cmd.Stdin = file
+	// don't wait forever for grandchildren that inherited stdout
+	cmd.WaitDelay = time.Second
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("preprocessor: %v", err)
+	}
+
+	// killing the converter on timeout ends its output, so the search
+	// itself only stops early for the run's own cancellation
+	matches, searchErr := grepReader(ctx, searchString, stdout)
+	// a search that stopped early must not leave the converter blocked
+	io.Copy(io.Discard, stdout)
+	waitErr := cmd.Wait()
+
+	if ctx.Err() != nil {
+		return matches, ctx.Err()
+	}
+	if errors.Is(preCtx.Err(), context.DeadlineExceeded) {
+		return nil, fmt.Errorf("preprocessor %s timed out after %s", preCommand, preTimeout)
+	}
+	if waitErr != nil {
+		message := strings.TrimSpace(stderr.String())
+		if line, _, _ := strings.Cut(message, "\n"); line != "" {
+			return nil, fmt.Errorf("preprocessor %s: %v: %s", preCommand, waitErr, line)
+		}
+		return nil, fmt.Errorf("preprocessor %s: %v", preCommand, waitErr)
+	}
+	return matches, searchErr
+}
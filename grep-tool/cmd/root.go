@@ -5,14 +5,21 @@ package cmd
 
 import (
 	"bufio"
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"io/fs"
 	"os"
+	"os/signal"
 	"path/filepath"
-	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"grep-cli/query"
 
 	"github.com/spf13/cobra"
 )
@@ -22,73 +29,280 @@ var caseInsensitive bool
 var recursive bool
 var after, before int
 var countOnly bool
+var showStats bool
+var timeout time.Duration
+var noConfig bool
+var typeNames, typeNotNames, typeAdditions []string
+var typeList bool
+var followSymlinks, oneFileSystem bool
+var newerThanFlag newerThan
+var maxFileSize, minFileSize byteSize = -1, -1
+var maxDepth = -1
+var jsonlFieldSpecs []string
+var fieldsFlag string
+var jsonlInvalid string
+
+// fieldPatterns and outputFields are parsed from --jsonl-field and --fields in Run.
+var fieldPatterns []fieldPattern
+var outputFields [][]string
+var queryExpr string
+var fuzzyDistance int
+var lineNumbers bool
+var nullSeparated bool
+var heading bool
+var listFiles, debug bool
+var filesFrom, files0From string
+
+// queryNode is the parsed --query expression, nil when searching for a plain string.
+var queryNode query.Node
+
+// typeFilter is built from the -t/-T flags in Run and consulted by recursiveSearch.
+var typeFilter *fileTypeFilter
+
+// exitCode is the status Execute exits with once the command has returned.
+// It lets Run report a failed or interrupted search without skipping
+// deferred output such as --stats.
+var exitCode int
+
+// exitUnreadable is the exit status of a search that ran to the end but
+// could not read some of its files or directories, so that it can be told
+// apart from a search that never ran, which exits with 1.
+const exitUnreadable = 3
+
+// searchStats collects counters across every input searched in a run.
+// Fields are atomic because recursiveSearch calls grepReader from many goroutines.
+type searchStats struct {
+	filesSearched atomic.Int64
+	filesMatched  atomic.Int64
+	linesScanned  atomic.Int64
+	bytesRead     atomic.Int64
+	matchesFound  atomic.Int64
+}
+
+var stats = &searchStats{}
 
 // rootCmd represents the base command when called without any subcommands
 var rootCmd = &cobra.Command{
-	Use:   "./mygrep <search_string> <filename> [-o out.txt]",
+	Use:   "mygrep SEARCH_STRING [FILE...]",
 	Short: "A grep-like command-line tool written in Go",
 	Long: `mygrep allows searching for text in files or directories, 
-	with options like case-insensitive search and output redirection.`,
-	Args: cobra.MinimumNArgs(1),
+	with options like case-insensitive search and output redirection.
+
+Default arguments are read from $XDG_CONFIG_HOME/mygrep/config (by default
+~/.config/mygrep/config), or from the file named by MYGREP_CONFIG_PATH, one
+argument per line. Blank lines and lines starting with # are ignored. Use
+--no-config to skip the file.
+
+mygrep exits with status 1 when a search fails or cannot start, 2 when it
+times out, 3 when it finishes but some files or directories could not be
+read, and 130 when it is interrupted.
+
+A search string that is also the name of a subcommand (completion, man,
+serve or tui) runs that subcommand instead; put -- before it to search for
+it, as in mygrep -- man notes.txt.`,
+	Args: func(cmd *cobra.Command, args []string) error {
+		if typeList || listFiles || len(jsonlFieldSpecs) > 0 || queryExpr != "" {
+			return nil
+		}
+		return cobra.MinimumNArgs(1)(cmd, args)
+	},
 
 	Run: func(cmd *cobra.Command, args []string) {
-		searchString := args[0]
-		var reader io.Reader
+		registry, err := newTypeRegistry(typeAdditions)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", os.Args[0], err)
+			os.Exit(1)
+		}
+		if typeList {
+			writeTypeList(os.Stdout, registry)
+			return
+		}
+		typeFilter, err = newFileTypeFilter(registry, typeNames, typeNotNames)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", os.Args[0], err)
+			os.Exit(1)
+		}
+
+		fieldPatterns, err = parseFieldPatterns(jsonlFieldSpecs)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", os.Args[0], err)
+			os.Exit(1)
+		}
+		if !validInvalidJSONPolicy(jsonlInvalid) {
+			fmt.Fprintf(os.Stderr, "%s: invalid --jsonl-invalid %q: want skip, raw or error\n", os.Args[0], jsonlInvalid)
+			os.Exit(1)
+		}
+		outputFields = parseFieldList(fieldsFlag)
+
+		queryNode = nil
+		if queryExpr != "" {
+			queryNode, err = query.Parse(queryExpr)
+			if err != nil {
+				reportQueryError(err)
+				os.Exit(1)
+			}
+			if caseInsensitive {
+				queryNode = query.Lower(queryNode)
+			}
+		}
+
+		groupKey = nil
+		if countByExpr != "" || bucketSize != 0 {
+			groupKey, err = newGroupKeyer(countByExpr, bucketSize)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "%s: %v\n", os.Args[0], err)
+				os.Exit(1)
+			}
+			defer func() { writeGroups(os.Stdout, groups.rows(bucketSize)) }()
+		}
+
+		// with --jsonl-field or --query the pattern comes from the flag, and
+		// --files has none, so every argument is a path
+		searchString, paths := "", args
+		if len(fieldPatterns) == 0 && queryNode == nil && !listFiles {
+			searchString, paths = args[0], args[1:]
+		}
+		var reader *os.File
+
+		ctx := cmd.Context()
+		if timeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, timeout)
+			defer cancel()
+		}
+
+		if showStats {
+			defer printStats(os.Stderr, stats, time.Now())
+		}
+
+		if filesFrom != "" || files0From != "" {
+			list, err := loadFileList()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "%s: %v\n", os.Args[0], err)
+				exitCode = 1
+				return
+			}
+			ok, err := searchFileList(ctx, searchString, append(paths, list...), os.Stdout)
+			if err != nil {
+				exitCode = reportCanceled(err)
+			} else if !ok {
+				exitCode = exitUnreadable
+			}
+			return
+		}
+
+		if err := checkSortFlags(); err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", os.Args[0], err)
+			exitCode = 1
+			return
+		}
+
+		if gitChangedBase != "" {
+			root := "."
+			if len(paths) > 0 {
+				root = paths[0]
+			}
+			changedFiles, err = newGitChangedFilter(ctx, root, gitChangedBase)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "%s: %v\n", os.Args[0], err)
+				exitCode = 1
+				return
+			}
+			recursive = true
+		}
+
+		if listFiles {
+			root := "."
+			if len(paths) > 0 {
+				root = paths[0]
+			}
+			ok, err := listSearchFiles(ctx, root, os.Stdout)
+			if err != nil {
+				exitCode = reportCanceled(err)
+			} else if !ok {
+				exitCode = exitUnreadable
+			}
+			return
+		}
+
+		if gitRev != "" {
+			root := "."
+			if len(paths) > 0 {
+				root = paths[0]
+			}
+			err := gitRevSearch(ctx, searchString, gitRev, root, os.Stdout)
+			if isCanceled(err) {
+				exitCode = reportCanceled(err)
+			} else if err != nil {
+				fmt.Fprintf(os.Stderr, "%s: %v\n", os.Args[0], err)
+				exitCode = 1
+			}
+			return
+		}
 
 		if recursive {
 			var filename string
-			if len(args) == 1 {
+			if len(paths) == 0 {
 				filename = "."
 			} else {
-				filename = args[1]
+				filename = paths[0]
+			}
+			ok, err := recursiveSearch(ctx, searchString, filename, os.Stdout)
+			if err != nil {
+				exitCode = reportCanceled(err)
+			} else if !ok {
+				exitCode = exitUnreadable
 			}
-			recursiveSearch(searchString, filename, os.Stdout)
 			return
 		}
 
-		if len(args) > 2 {
-			for _, arg := range args {
-				if arg == searchString {
-					continue
-				}
-				filename := arg
+		if len(paths) > 1 {
+			for _, filename := range paths {
 				file, err := validateFile(filename)
 				if err != nil {
 					fmt.Fprintln(os.Stderr, err)
-					os.Exit(1)
+					exitCode = 1
+					return
 				}
 				defer file.Close()
 				reader = file
 
-				matches, err := grepReader(searchString, reader)
-				if err != nil {
+				matches, err := grepFile(ctx, searchString, reader)
+				if err != nil && !isCanceled(err) {
 					fmt.Fprintf(os.Stderr, "%s: %v\n", os.Args[0], err)
-					os.Exit(1)
+					exitCode = 1
+					return
 				}
 				writeStdout(matches, os.Stdout)
+				if err != nil {
+					exitCode = reportCanceled(err)
+					return
+				}
 			}
 			return
 		}
 
-		if len(args) == 1 {
+		if len(paths) == 0 {
 			reader = os.Stdin
 		}
 
-		if len(args) == 2 {
-			filename := args[1]
+		if len(paths) == 1 {
+			filename := paths[0]
 			file, err := validateFile(filename)
 			if err != nil {
 				fmt.Fprintln(os.Stderr, err)
-				os.Exit(1)
+				exitCode = 1
+				return
 			}
 			defer file.Close()
 			reader = file
 		}
 
-		matches, err := grepReader(searchString, reader)
-		if err != nil {
-			fmt.Fprintf(os.Stderr, "%s: %v\n", os.Args[0], err)
-			os.Exit(1)
+		matches, searchErr := grepFile(ctx, searchString, reader)
+		if searchErr != nil && !isCanceled(searchErr) {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", os.Args[0], searchErr)
+			exitCode = 1
+			return
 		}
 
 		if outFile == "" {
@@ -97,27 +311,170 @@ var rootCmd = &cobra.Command{
 			err := writeToFile(outFile, matches)
 			if err != nil {
 				fmt.Fprintf(os.Stderr, "%s: %v\n", os.Args[0], err)
-				os.Exit(1)
+				exitCode = 1
+				return
 			}
 		}
+
+		if searchErr != nil {
+			exitCode = reportCanceled(searchErr)
+		}
 	},
 }
 
+// Execute runs the root command with a context that is cancelled on SIGINT
+// or SIGTERM, so an interrupted search stops cleanly and keeps its output.
 func Execute() {
-	err := rootCmd.Execute()
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	args := os.Args[1:]
+	if !isSubcommand(args) {
+		args = argsWithConfig(args)
+	}
+	rootCmd.SetArgs(args)
+	err := rootCmd.ExecuteContext(ctx)
+	stop()
 	if err != nil {
 		os.Exit(1)
 	}
+	os.Exit(exitCode)
 }
 
 func init() {
-	rootCmd.Flags().BoolP("toggle", "t", false, "Help message for toggle")
 	rootCmd.Flags().StringVarP(&outFile, "out", "o", "", "Write output to file instead of stdout")
 	rootCmd.Flags().BoolVarP(&caseInsensitive, "i", "i", false, "Ignore case when searching")
 	rootCmd.Flags().BoolVarP(&recursive, "r", "r", false, "Search recursively in directories")
 	rootCmd.Flags().IntVarP(&after, "after", "A", 0, "Print n lines after match")
 	rootCmd.Flags().IntVarP(&before, "before", "B", 0, "Print n lines before match")
 	rootCmd.Flags().BoolVarP(&countOnly, "count", "c", false, "Only print count of matches")
+	rootCmd.Flags().BoolVarP(&lineNumbers, "line-number", "n", false, "Prefix each output line with its line number")
+	rootCmd.Flags().BoolVarP(&nullSeparated, "null", "Z", false, "Print a NUL byte after file names instead of ':' (or the newline after a --heading)")
+	rootCmd.Flags().BoolVar(&heading, "heading", false, "Print each file name once above its matches instead of on every line")
+	rootCmd.Flags().StringVar(&sortBy, "sort", "", "Print recursive results sorted by path, modified, accessed, created or none")
+	rootCmd.Flags().StringVar(&sortReverse, "sortr", "", "Like --sort, in reverse order")
+	rootCmd.MarkFlagsMutuallyExclusive("sort", "sortr")
+	rootCmd.Flags().BoolVar(&listFiles, "files", false, "Print the files a recursive search would read, without searching them")
+	rootCmd.Flags().BoolVar(&debug, "debug", false, "Explain on stderr why each skipped path is not searched")
+	rootCmd.Flags().BoolVar(&forceMmap, "mmap", false, "Search every regular file through a memory map, not only large ones")
+	rootCmd.Flags().BoolVar(&noMmap, "no-mmap", false, "Never search files through a memory map")
+	rootCmd.MarkFlagsMutuallyExclusive("mmap", "no-mmap")
+	rootCmd.Flags().StringVar(&filesFrom, "files-from", "", "Search the newline-separated file names listed in FILE (- for stdin)")
+	rootCmd.Flags().StringVar(&files0From, "files0-from", "", "Search the NUL-separated file names listed in FILE (- for stdin)")
+	rootCmd.MarkFlagsMutuallyExclusive("files-from", "files0-from", "r")
+	rootCmd.Flags().BoolVar(&showStats, "stats", false, "Print search statistics to stderr after the run")
+	rootCmd.Flags().BoolVar(&noConfig, "no-config", false, "Ignore the config file and MYGREP_CONFIG_PATH")
+	rootCmd.Flags().StringArrayVarP(&typeNames, "type", "t", nil, "Only search files of this type when recursing (repeatable)")
+	rootCmd.Flags().StringArrayVarP(&typeNotNames, "type-not", "T", nil, "Skip files of this type when recursing (repeatable)")
+	rootCmd.Flags().StringArrayVar(&typeAdditions, "type-add", nil, "Add a file type, e.g. 'web:*.html,*.css' (repeatable)")
+	rootCmd.Flags().BoolVar(&typeList, "type-list", false, "Print the known file types and exit")
+	rootCmd.Flags().BoolVarP(&followSymlinks, "follow-symlinks", "L", false, "Follow symbolic links when recursing")
+	rootCmd.Flags().BoolVar(&oneFileSystem, "one-file-system", false, "Do not descend into directories on other file systems")
+	rootCmd.Flags().Var(&newerThanFlag, "newer-than", "Only search files modified within DURATION (e.g. 1h) or since DATE")
+	rootCmd.Flags().Var(&maxFileSize, "max-filesize", "Skip files larger than SIZE (e.g. 10M)")
+	rootCmd.Flags().Var(&minFileSize, "min-filesize", "Skip files smaller than SIZE (e.g. 1K)")
+	rootCmd.Flags().IntVar(&maxDepth, "max-depth", -1, "Descend at most N directory levels below the search root")
+	rootCmd.Flags().StringArrayVar(&jsonlFieldSpecs, "jsonl-field", nil, "Parse lines as JSON and match PATTERN against a dotted field PATH, e.g. level=error (repeatable)")
+	rootCmd.Flags().StringVar(&fieldsFlag, "fields", "", "Print only these comma-separated JSON fields of each line, e.g. ts,msg")
+	rootCmd.Flags().StringVar(&jsonlInvalid, "jsonl-invalid", invalidJSONSkip, "How --jsonl-field treats non-JSON lines: skip, raw or error")
+	rootCmd.Flags().StringVar(&queryExpr, "query", "", `Match lines against a boolean expression, e.g. 'timeout AND db AND NOT retry'`)
+	rootCmd.Flags().IntVar(&fuzzyDistance, "fuzzy", -1, "Match substrings within N edits of the pattern; matches are prefixed with start-end:distance:")
+	rootCmd.MarkFlagsMutuallyExclusive("query", "jsonl-field", "fuzzy")
+	rootCmd.Flags().StringVar(&gitChangedBase, "git-changed", "", "Search only files changed from git revision BASE, e.g. HEAD for uncommitted changes; implies -r")
+	rootCmd.Flags().StringVar(&gitRev, "git-rev", "", "Search the files as committed at git revision REV, labelling matches REV:path")
+	rootCmd.MarkFlagsMutuallyExclusive("git-rev", "files-from", "files0-from")
+	rootCmd.MarkFlagsMutuallyExclusive("git-changed", "files-from", "files0-from")
+	rootCmd.MarkFlagsMutuallyExclusive("files", "git-rev")
+	rootCmd.Flags().StringVar(&preCommand, "pre", "", "Search the output of COMMAND FILE instead of each file, e.g. a pdftotext wrapper")
+	rootCmd.Flags().StringArrayVar(&preGlobs, "pre-glob", nil, "Only use --pre for files matching GLOB; prefix with ! to exclude (repeatable)")
+	rootCmd.Flags().DurationVar(&preTimeout, "pre-timeout", 30*time.Second, "Give up on a --pre command after this long (0 means no limit)")
+	rootCmd.Flags().StringVar(&countByExpr, "count-by", "", "Count matches per value of the first capture group of REGEX and print a table")
+	rootCmd.Flags().DurationVar(&bucketSize, "bucket", 0, "Count matches per time bucket, e.g. 1m, of the line's timestamp (or the --count-by capture)")
+	rootCmd.Flags().BoolVar(&histogram, "histogram", false, "Print --count-by or --bucket counts as an ASCII histogram")
+	rootCmd.Flags().DurationVar(&timeout, "timeout", 0, "Stop searching after this long, e.g. 30s (0 means no limit)")
+}
+
+// isSubcommand reports whether args invoke a subcommand such as man or
+// completion, whose flags differ from the search flags in the config file.
+func isSubcommand(args []string) bool {
+	if len(args) > 0 && (args[0] == cobra.ShellCompRequestCmd || args[0] == cobra.ShellCompNoDescRequestCmd) {
+		return true
+	}
+	cmd, _, err := rootCmd.Find(args)
+	return err == nil && cmd != rootCmd
+}
+
+// configPath returns MYGREP_CONFIG_PATH if set, otherwise mygrep/config
+// under $XDG_CONFIG_HOME, or under ~/.config when that isn't set. Unlike
+// os.UserConfigDir, this is the same place on macOS as on Linux.
+func configPath() string {
+	path := os.Getenv("MYGREP_CONFIG_PATH")
+	if path != "" {
+		return path
+	}
+
+	// the XDG spec says to ignore a relative XDG_CONFIG_HOME
+	dir := os.Getenv("XDG_CONFIG_HOME")
+	if !filepath.IsAbs(dir) {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return ""
+		}
+		dir = filepath.Join(home, ".config")
+	}
+	return filepath.Join(dir, "mygrep", "config")
+}
+
+func loadConfigArgs(path string) ([]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var args []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		args = append(args, line)
+	}
+
+	err = scanner.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	return args, nil
+}
+
+// argsWithConfig prepends the config file arguments to args, unless
+// --no-config appears before any "--" terminator. A missing default config
+// is not an error; an unreadable one is reported and skipped.
+func argsWithConfig(args []string) []string {
+	for _, arg := range args {
+		if arg == "--" {
+			break
+		}
+		if arg == "--no-config" {
+			return args
+		}
+	}
+
+	path := configPath()
+	if path == "" {
+		return args
+	}
+
+	defaults, err := loadConfigArgs(path)
+	if err != nil {
+		if os.Getenv("MYGREP_CONFIG_PATH") != "" || !errors.Is(err, fs.ErrNotExist) {
+			fmt.Fprintf(os.Stderr, "%s: config: %v\n", os.Args[0], err)
+		}
+		return args
+	}
+
+	return append(defaults, args...)
 }
 
 func validateFile(filename string) (*os.File, error) {
@@ -130,6 +487,7 @@ func validateFile(filename string) (*os.File, error) {
 		if os.IsNotExist(err) {
 			return nil, fmt.Errorf("%s: %s: open: No such file or directory", os.Args[0], filename)
 		}
+		return nil, fmt.Errorf("%s: %v", os.Args[0], err)
 	}
 
 	info, _ := file.Stat()
@@ -142,66 +500,134 @@ func validateFile(filename string) (*os.File, error) {
 	return file, nil
 }
 
-func grepReader(searchString string, reader io.Reader) ([]string, error) {
-	var matches []string
-	var count int
-
-	scanner := bufio.NewScanner(reader)
-
-	if caseInsensitive {
-		searchString = strings.ToLower(searchString)
+// reportQueryError prints a --query syntax error with a caret under the
+// offending column.
+func reportQueryError(err error) {
+	var syntaxErr *query.SyntaxError
+	if errors.As(err, &syntaxErr) {
+		fmt.Fprintf(os.Stderr, "%s: invalid query: %v\n", os.Args[0], err)
+		for _, line := range strings.Split(syntaxErr.Caret(), "\n") {
+			fmt.Fprintf(os.Stderr, "  %s\n", line)
+		}
+		return
 	}
+	fmt.Fprintf(os.Stderr, "%s: invalid query: %v\n", os.Args[0], err)
+}
 
-	beforeBuffer := make([]string, 0, before)
-	afterRemaining := 0
+func isCanceled(err error) bool {
+	return errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded)
+}
 
-	for scanner.Scan() {
-		line := scanner.Text()
-		compareLine := line
-		if caseInsensitive {
-			compareLine = strings.ToLower(line)
-		}
+// reportCanceled explains on stderr why the search stopped early and returns
+// the exit status to use: 130 for an interrupt, 2 for a timeout.
+func reportCanceled(err error) int {
+	if errors.Is(err, context.DeadlineExceeded) {
+		fmt.Fprintf(os.Stderr, "%s: search timed out after %s\n", os.Args[0], timeout)
+		return 2
+	}
+	fmt.Fprintf(os.Stderr, "%s: search interrupted\n", os.Args[0])
+	return 130
+}
 
-		match := strings.Contains(compareLine, searchString)
+// grepReader returns the matching lines read so far. If ctx is cancelled the
+// partial result is returned together with ctx.Err().
+func grepReader(ctx context.Context, searchString string, reader io.Reader) ([]string, error) {
+	counter := &countingReader{r: reader}
+	result := scanLines(ctx, bufio.NewScanner(counter), newLineMatcher(searchString))
+	recordStats(result.lines, counter.n, result.count)
 
-		if match {
-			count++
-			if countOnly {
-				continue
-			}
-
-			for _, b := range beforeBuffer {
-				matches = append(matches, b)
-			}
+	return mergeChunks([]chunkResult{result})
+}
 
-			beforeBuffer = beforeBuffer[:0]
+// lineMatcher decides whether a single line matches, using whichever of
+// --jsonl-field, --query, --fuzzy or the plain search string is in effect.
+type lineMatcher struct {
+	searchString string
+	fuzzy        *fuzzyMatcher
+}
 
-			matches = append(matches, line)
+func newLineMatcher(searchString string) *lineMatcher {
+	if caseInsensitive {
+		searchString = strings.ToLower(searchString)
+	}
 
-			afterRemaining = after
+	m := &lineMatcher{searchString: searchString}
+	if fuzzyDistance >= 0 {
+		m.fuzzy = newFuzzyMatcher(searchString, fuzzyDistance)
+	}
+	return m
+}
 
-		} else if afterRemaining > 0 {
-			matches = append(matches, line)
-			afterRemaining--
+// match returns whether line matches, the prefix to print before it when
+// it does, and the text to print for it. The text of a line that doesn't
+// match is never projected with --fields.
+func (m *lineMatcher) match(line string) (matched bool, prefix string, text string, err error) {
+	compareLine := line
+	if caseInsensitive {
+		compareLine = strings.ToLower(line)
+	}
 
-		} else if before > 0 {
-			if len(beforeBuffer) == before {
-				beforeBuffer = beforeBuffer[1:]
-			}
-			beforeBuffer = append(beforeBuffer, line)
+	// a JSON line is decoded at most once, for matching and projection both
+	var object map[string]any
+	decoded := false
+	if len(fieldPatterns) > 0 {
+		object, _ = parseJSONObject(line)
+		decoded = true
+		matched, err = matchJSONLine(line, object)
+		if err != nil {
+			return false, "", "", err
 		}
+	} else if queryNode != nil {
+		matched = queryNode.Match(compareLine)
+	} else if m.fuzzy != nil {
+		var span fuzzyMatch
+		span, matched = m.fuzzy.find(compareLine)
+		prefix = fmt.Sprintf("%d-%d:%d:", span.start+1, span.end, span.distance)
+	} else {
+		matched = strings.Contains(compareLine, m.searchString)
 	}
 
-	err := scanner.Err()
-	if err != nil {
-		return nil, err
+	// only matches are projected here; context lines are projected by
+	// searchChunk if they are kept
+	text = line
+	if matched && len(outputFields) > 0 {
+		if !decoded {
+			object, _ = parseJSONObject(line)
+		}
+		text = projectFields(line, object)
 	}
+	return matched, prefix, text, nil
+}
 
-	if countOnly {
-		return []string{strconv.Itoa(count)}, nil
+func recordStats(lines, bytesRead int64, count int) {
+	stats.filesSearched.Add(1)
+	stats.linesScanned.Add(lines)
+	stats.bytesRead.Add(bytesRead)
+	stats.matchesFound.Add(int64(count))
+	if count > 0 {
+		stats.filesMatched.Add(1)
 	}
+}
+
+// countingReader counts the bytes read through it.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
 
-	return matches, nil
+func printStats(w io.Writer, s *searchStats, start time.Time) {
+	fmt.Fprintf(w, "files searched: %d\n", s.filesSearched.Load())
+	fmt.Fprintf(w, "files matched:  %d\n", s.filesMatched.Load())
+	fmt.Fprintf(w, "lines scanned:  %d\n", s.linesScanned.Load())
+	fmt.Fprintf(w, "bytes read:     %d\n", s.bytesRead.Load())
+	fmt.Fprintf(w, "matches found:  %d\n", s.matchesFound.Load())
+	fmt.Fprintf(w, "elapsed:        %s\n", time.Since(start))
 }
 
 func writeStdout(lines []string, out io.Writer) {
@@ -235,21 +661,80 @@ func writeToFile(outPath string, lines []string) error {
 
 func WriteToStdOutForRecursiveFiles(w io.Writer, lines []string, filename string) {
 	for _, line := range lines {
-		fmt.Fprintf(w, "%s:%s\n", filename, line)
+		fmt.Fprintf(w, "%s%s%s\n", filename, filenameSeparator(), line)
+	}
+}
+
+// resultWriter prints the matches of one file after another, each line
+// prefixed with the file name or, with --heading, under the name as a
+// heading with a blank line between files.
+type resultWriter struct {
+	out   io.Writer
+	wrote bool
+}
+
+func (w *resultWriter) write(filename string, lines []string) {
+	if len(lines) == 0 {
+		return
+	}
+	if !heading {
+		WriteToStdOutForRecursiveFiles(w.out, lines, filename)
+		return
+	}
+
+	if w.wrote {
+		fmt.Fprintln(w.out)
+	}
+	w.wrote = true
+	// the heading ends with a NUL byte instead of the newline with -Z, as
+	// a file name does everywhere else
+	if nullSeparated {
+		fmt.Fprint(w.out, filename, filenameSeparator())
+	} else {
+		fmt.Fprintln(w.out, filename)
+	}
+	for _, line := range lines {
+		fmt.Fprintln(w.out, line)
+	}
+}
+
+// filenameSeparator is what follows a file name in output: ':' or, with -Z,
+// a NUL byte so that names containing ':' or spaces stay unambiguous.
+func filenameSeparator() string {
+	if nullSeparated {
+		return "\x00"
 	}
+	return ":"
 }
 
-func recursiveSearch(searchString, root string, out io.Writer) {
+// pathDepth returns how many levels below root path is; root itself is 0.
+func pathDepth(root, path string) int {
+	rel, err := filepath.Rel(root, path)
+	if err != nil || rel == "." {
+		return 0
+	}
+	return strings.Count(rel, string(filepath.Separator)) + 1
+}
+
+// recursiveSearch greps every file under root. Cancelling ctx stops the walk
+// and the workers; whatever they matched so far is still written to out.
+// Files are printed as their workers finish unless --sort asks for an order,
+// in which case they are collected and printed once all are done. Files and
+// directories that cannot be read are reported and skipped; ok is false if
+// there were any.
+func recursiveSearch(ctx context.Context, searchString, root string, out io.Writer) (ok bool, err error) {
 	var wg sync.WaitGroup
 	var mu sync.Mutex
+	var failed atomic.Bool
+	writer := &resultWriter{out: out}
+	key, reverse := sortOrder()
+	var results []fileResult
 
-	filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+	walkSearchFiles(ctx, root, func(path string, err error) {
 		if err != nil {
-			return nil
-		}
-
-		if d.IsDir() {
-			return nil
+			fmt.Fprintf(os.Stderr, "%s: %v\n", os.Args[0], err)
+			failed.Store(true)
+			return
 		}
 
 		wg.Add(1)
@@ -258,25 +743,150 @@ func recursiveSearch(searchString, root string, out io.Writer) {
 
 			file, err := validateFile(path)
 			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				failed.Store(true)
 				return
 			}
 			defer file.Close()
 
-			matches, err := grepReader(searchString, file)
-			if err != nil {
-				fmt.Fprintf(os.Stderr, "%s: %v\n", os.Args[0], err)
+			// stat before reading so the access time is not our own
+			info, _ := file.Stat()
+
+			matches, err := grepFile(ctx, searchString, file)
+			if err != nil && !isCanceled(err) {
+				fmt.Fprintf(os.Stderr, "%s: %s: %v\n", os.Args[0], path, err)
+				failed.Store(true)
 				return
 			}
 
 			if len(matches) > 0 {
 				mu.Lock()
-				WriteToStdOutForRecursiveFiles(out, matches, path)
-				mu.Unlock()
+				defer mu.Unlock()
+				if key == sortNone {
+					writer.write(path, matches)
+				} else {
+					results = append(results, newFileResult(path, matches, info, key))
+				}
 			}
 		}(path)
+	})
+
+	wg.Wait()
+
+	sortResults(results, key, reverse)
+	for _, result := range results {
+		writer.write(result.path, result.matches)
+	}
+	return !failed.Load(), ctx.Err()
+}
 
+// walkSearchFiles calls visit for every file under root that passes the
+// symlink, type, size, age and depth filters, stopping when ctx is done.
+// A directory that cannot be read, or a root that doesn't exist, is passed
+// to visit with the error instead. With --debug every path it leaves out is
+// reported with the reason.
+func walkSearchFiles(ctx context.Context, root string, visit func(path string, err error)) {
+	walkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return ctxErr
+		}
+
+		if errors.Is(err, errDirectoryLoop) {
+			fmt.Fprintf(os.Stderr, "%s: warning: %s: recursive directory loop\n", os.Args[0], path)
+			return nil
+		}
+
+		if err != nil {
+			visit(path, err)
+			return nil
+		}
+
+		if d.IsDir() {
+			if maxDepth >= 0 && pathDepth(root, path) >= maxDepth {
+				debugSkip(path, fmt.Sprintf("deeper than --max-depth %d", maxDepth))
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		// without -L, symlinks found while recursing are not searched
+		if d.Type()&fs.ModeSymlink != 0 {
+			debugSkip(path, "symbolic link, use -L to follow")
+			return nil
+		}
+
+		if reason := typeFilter.skipReason(path); reason != "" {
+			debugSkip(path, reason)
+			return nil
+		}
+		if !changedFiles.allows(path) {
+			debugSkip(path, "unchanged since "+gitChangedBase+" (--git-changed)")
+			return nil
+		}
+
+		if hasFileInfoFilters() {
+			info, err := d.Info()
+			if err != nil {
+				debugSkip(path, err.Error())
+				return nil
+			}
+			if reason := fileInfoSkipReason(info); reason != "" {
+				debugSkip(path, reason)
+				return nil
+			}
+		}
+
+		visit(path, nil)
 		return nil
 	})
+}
 
-	wg.Wait()
+// debugSkip explains on stderr, with --debug, why path is not searched.
+func debugSkip(path, reason string) {
+	if debug {
+		fmt.Fprintf(os.Stderr, "%s: debug: skipping %s: %s\n", os.Args[0], path, reason)
+	}
+}
+
+// listSearchFiles prints the files recursiveSearch would search under root,
+// one per line (NUL-terminated with -Z), in walk order or --sort order.
+// Files and directories that cannot be read are reported as recursiveSearch
+// reports them instead of listed; ok is false if there were any.
+func listSearchFiles(ctx context.Context, root string, out io.Writer) (ok bool, err error) {
+	terminator := "\n"
+	if nullSeparated {
+		terminator = "\x00"
+	}
+
+	ok = true
+	key, reverse := sortOrder()
+	var results []fileResult
+	walkSearchFiles(ctx, root, func(path string, err error) {
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", os.Args[0], err)
+			ok = false
+			return
+		}
+
+		file, err := validateFile(path)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			ok = false
+			return
+		}
+		file.Close()
+
+		if key == sortNone {
+			fmt.Fprint(out, path+terminator)
+			return
+		}
+		info, _ := os.Stat(path)
+		results = append(results, newFileResult(path, nil, info, key))
+	})
+
+	sortResults(results, key, reverse)
+	for _, result := range results {
+		fmt.Fprint(out, result.path+terminator)
+	}
+	return ok, ctx.Err()
 }
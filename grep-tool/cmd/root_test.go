@@ -1,12 +1,31 @@
 package cmd
 
 import (
+	"bufio"
 	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"os"
+	"os/exec"
 	"path/filepath"
+	"reflect"
+	"runtime"
+	"sort"
 	"strings"
+	"sync"
 	"testing"
+	"time"
+
+	"grep-cli/query"
 )
 
 type grepTestCase struct {
@@ -85,7 +104,7 @@ func TestGrepReader(t *testing.T) {
 		caseInsensitive = grepTestCase.caseInsensitive
 
 		reader := strings.NewReader(grepTestCase.input)
-		gotMatches, _ := grepReader(grepTestCase.searchString, reader)
+		gotMatches, _ := grepReader(context.Background(), grepTestCase.searchString, reader)
 
 		for i := range gotMatches {
 			if gotMatches[i] != grepTestCase.wantMatches[i] {
@@ -207,7 +226,7 @@ func TestRecursiveSearch(t *testing.T) {
 	os.WriteFile(file2, []byte("Hello from dir2"), 0644)
 
 	var buf bytes.Buffer
-	recursiveSearch("hello", tmp, &buf)
+	recursiveSearch(context.Background(), "hello", tmp, &buf)
 	got := buf.String()
 
 	want1 := fmt.Sprintf("%s:Hello from dir1\n", file1)
@@ -236,3 +255,2151 @@ func TestWriteStdout(t *testing.T) {
 	}
 
 }
+
+func TestSearchStats(t *testing.T) {
+	countOnly = false
+	before = 0
+	after = 0
+	caseInsensitive = false
+	stats = &searchStats{}
+
+	tmp := t.TempDir()
+	os.WriteFile(filepath.Join(tmp, "a.txt"), []byte("error one\nok\nerror two\n"), 0644)
+	os.WriteFile(filepath.Join(tmp, "b.txt"), []byte("nothing here\n"), 0644)
+
+	var buf bytes.Buffer
+	recursiveSearch(context.Background(), "error", tmp, &buf)
+
+	if got := stats.filesSearched.Load(); got != 2 {
+		t.Errorf("filesSearched = %d, want 2", got)
+	}
+	if got := stats.filesMatched.Load(); got != 1 {
+		t.Errorf("filesMatched = %d, want 1", got)
+	}
+	if got := stats.linesScanned.Load(); got != 4 {
+		t.Errorf("linesScanned = %d, want 4", got)
+	}
+	if got := stats.bytesRead.Load(); got != 36 {
+		t.Errorf("bytesRead = %d, want 36", got)
+	}
+	if got := stats.matchesFound.Load(); got != 2 {
+		t.Errorf("matchesFound = %d, want 2", got)
+	}
+
+	var out bytes.Buffer
+	printStats(&out, stats, time.Now())
+	if !strings.Contains(out.String(), "matches found:  2\n") {
+		t.Errorf("printStats() output missing match count:\n%s", out.String())
+	}
+}
+
+func TestSearchStatsOnError(t *testing.T) {
+	// run this test binary as mygrep, so the exit path is the real one
+	cmd := exec.Command(os.Args[0], "--no-config", "--stats", "error", filepath.Join(t.TempDir(), "missing.txt"))
+	cmd.Env = append(os.Environ(), "MYGREP_TEST_SEARCH_PROCESS=1")
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+
+	err := cmd.Run()
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) || exitErr.ExitCode() != 1 {
+		t.Errorf("exit error = %v, want exit status 1", err)
+	}
+	if !strings.Contains(stderr.String(), "files searched: 0\n") {
+		t.Errorf("--stats output missing after a failed search:\n%s", stderr.String())
+	}
+}
+
+func TestSearchForSubcommandName(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "notes.txt")
+	os.WriteFile(path, []byte("see the man page\nnothing here\n"), 0644)
+
+	run := func(args ...string) (string, error) {
+		cmd := exec.Command(os.Args[0], args...)
+		cmd.Env = append(os.Environ(), "MYGREP_TEST_SEARCH_PROCESS=1")
+		out, err := cmd.Output()
+		return string(out), err
+	}
+
+	// a subcommand name runs the subcommand, which takes no file
+	if out, err := run("man", path); err == nil {
+		t.Errorf("mygrep man FILE succeeded with output %q, want the man subcommand to reject FILE", out)
+	}
+
+	out, err := run("--no-config", "--", "man", path)
+	if err != nil {
+		t.Fatalf("mygrep -- man FILE error = %v", err)
+	}
+	if out != "see the man page\n" {
+		t.Errorf("mygrep -- man FILE = %q, want %q", out, "see the man page\n")
+	}
+}
+
+func TestGrepReaderCanceled(t *testing.T) {
+	countOnly = false
+	before = 0
+	after = 0
+	caseInsensitive = false
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err := grepReader(ctx, "cat", strings.NewReader("cat\ncat\n"))
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("grepReader() error = %v, want %v", err, context.Canceled)
+	}
+}
+
+func TestRecursiveSearchTimeout(t *testing.T) {
+	countOnly = false
+	before = 0
+	after = 0
+	caseInsensitive = false
+
+	tmp := t.TempDir()
+	os.WriteFile(filepath.Join(tmp, "file.txt"), []byte("hello\n"), 0644)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Nanosecond)
+	defer cancel()
+	<-ctx.Done()
+
+	var buf bytes.Buffer
+	_, err := recursiveSearch(ctx, "hello", tmp, &buf)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("recursiveSearch() error = %v, want %v", err, context.DeadlineExceeded)
+	}
+	if buf.Len() != 0 {
+		t.Errorf("expected no output after deadline, got %q", buf.String())
+	}
+}
+
+func TestArgsWithConfig(t *testing.T) {
+	tmp := t.TempDir()
+	config := filepath.Join(tmp, "config")
+	os.WriteFile(config, []byte("# defaults\n-i\n\n  --timeout=5s  \n"), 0644)
+	t.Setenv("MYGREP_CONFIG_PATH", config)
+
+	got := argsWithConfig([]string{"hello", "file.txt"})
+	want := []string{"-i", "--timeout=5s", "hello", "file.txt"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("argsWithConfig() = %q, want %q", got, want)
+	}
+
+	// --no-config leaves the arguments untouched
+	got = argsWithConfig([]string{"--no-config", "hello"})
+	want = []string{"--no-config", "hello"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("argsWithConfig() = %q, want %q", got, want)
+	}
+
+	// --no-config after -- is a search string, not a flag
+	got = argsWithConfig([]string{"--", "--no-config"})
+	want = []string{"-i", "--timeout=5s", "--", "--no-config"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("argsWithConfig() = %q, want %q", got, want)
+	}
+
+	// a missing default config is silently ignored
+	t.Setenv("MYGREP_CONFIG_PATH", "")
+	t.Setenv("XDG_CONFIG_HOME", filepath.Join(tmp, "nothing-here"))
+	got = argsWithConfig([]string{"hello"})
+	want = []string{"hello"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("argsWithConfig() = %q, want %q", got, want)
+	}
+}
+
+func TestConfigPath(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv("MYGREP_CONFIG_PATH", "")
+
+	t.Setenv("XDG_CONFIG_HOME", "/xdg")
+	if got, want := configPath(), filepath.Join("/xdg", "mygrep", "config"); got != want {
+		t.Errorf("configPath() = %q, want %q", got, want)
+	}
+
+	// unset or relative, XDG_CONFIG_HOME falls back to ~/.config
+	for _, xdg := range []string{"", "relative/dir"} {
+		t.Setenv("XDG_CONFIG_HOME", xdg)
+		if got, want := configPath(), filepath.Join(home, ".config", "mygrep", "config"); got != want {
+			t.Errorf("XDG_CONFIG_HOME=%q: configPath() = %q, want %q", xdg, got, want)
+		}
+	}
+
+	t.Setenv("MYGREP_CONFIG_PATH", "/etc/mygrep")
+	if got := configPath(); got != "/etc/mygrep" {
+		t.Errorf("configPath() = %q, want /etc/mygrep", got)
+	}
+}
+
+func TestRecursiveSearchTypeFilter(t *testing.T) {
+	countOnly = false
+	before = 0
+	after = 0
+	caseInsensitive = false
+	defer func() { typeFilter = nil }()
+
+	tmp := t.TempDir()
+	goFile := filepath.Join(tmp, "main.go")
+	yamlFile := filepath.Join(tmp, "config.yaml")
+	txtFile := filepath.Join(tmp, "notes.txt")
+	os.WriteFile(goFile, []byte("needle\n"), 0644)
+	os.WriteFile(yamlFile, []byte("needle\n"), 0644)
+	os.WriteFile(txtFile, []byte("needle\n"), 0644)
+
+	registry, err := newTypeRegistry([]string{"notes:*.txt"})
+	if err != nil {
+		t.Fatalf("newTypeRegistry() error = %v", err)
+	}
+
+	typeFilter, err = newFileTypeFilter(registry, []string{"go", "notes"}, []string{"notes"})
+	if err != nil {
+		t.Fatalf("newFileTypeFilter() error = %v", err)
+	}
+
+	var buf bytes.Buffer
+	recursiveSearch(context.Background(), "needle", tmp, &buf)
+	got := buf.String()
+
+	if !strings.Contains(got, goFile+":needle\n") {
+		t.Errorf("expected %s to be searched, got:\n%s", goFile, got)
+	}
+	if strings.Contains(got, yamlFile) || strings.Contains(got, txtFile) {
+		t.Errorf("expected only %s to be searched, got:\n%s", goFile, got)
+	}
+
+	_, err = newFileTypeFilter(registry, []string{"nope"}, nil)
+	if err == nil || !strings.Contains(err.Error(), "unrecognized file type") {
+		t.Errorf("expected unrecognized type error, got %v", err)
+	}
+
+	_, err = newTypeRegistry([]string{"broken"})
+	if err == nil {
+		t.Errorf("expected error for type definition without a glob")
+	}
+}
+
+func TestRecursiveSearchSymlinks(t *testing.T) {
+	countOnly = false
+	before = 0
+	after = 0
+	caseInsensitive = false
+	defer func() { followSymlinks = false }()
+
+	tmp := t.TempDir()
+	dirA := filepath.Join(tmp, "a")
+	os.MkdirAll(dirA, 0755)
+	os.WriteFile(filepath.Join(dirA, "file.txt"), []byte("needle\n"), 0644)
+
+	// a/loop points back at its own parent, b is a second route into a
+	os.Symlink(dirA, filepath.Join(dirA, "loop"))
+	os.Symlink(dirA, filepath.Join(tmp, "b"))
+	os.Symlink(filepath.Join(dirA, "file.txt"), filepath.Join(tmp, "link.txt"))
+	os.Symlink(filepath.Join(tmp, "missing"), filepath.Join(tmp, "dangling"))
+
+	search := func() string {
+		var buf bytes.Buffer
+		_, err := recursiveSearch(context.Background(), "needle", tmp, &buf)
+		if err != nil {
+			t.Fatalf("recursiveSearch() error = %v", err)
+		}
+		return buf.String()
+	}
+
+	followSymlinks = false
+	got := search()
+	want := filepath.Join(dirA, "file.txt") + ":needle\n"
+	if got != want {
+		t.Errorf("without -L got:\n%s\nwant:\n%s", got, want)
+	}
+
+	followSymlinks = true
+	got = search()
+	for _, path := range []string{
+		filepath.Join(tmp, "a", "file.txt"),
+		filepath.Join(tmp, "b", "file.txt"),
+		filepath.Join(tmp, "link.txt"),
+	} {
+		if !strings.Contains(got, path+":needle\n") {
+			t.Errorf("with -L expected %s in output, got:\n%s", path, got)
+		}
+	}
+	if strings.Contains(got, filepath.Join("loop", "file.txt")) {
+		t.Errorf("with -L the symlink loop was followed:\n%s", got)
+	}
+	if n := strings.Count(got, "\n"); n != 3 {
+		t.Errorf("with -L expected 3 matches, got %d:\n%s", n, got)
+	}
+}
+
+func TestWalkDirReportsLoop(t *testing.T) {
+	followSymlinks = true
+	defer func() { followSymlinks = false }()
+
+	tmp := t.TempDir()
+	os.Symlink(tmp, filepath.Join(tmp, "self"))
+
+	var loops []string
+	walkDir(tmp, func(path string, d fs.DirEntry, err error) error {
+		if errors.Is(err, errDirectoryLoop) {
+			loops = append(loops, path)
+		}
+		return nil
+	})
+
+	want := []string{filepath.Join(tmp, "self")}
+	if !reflect.DeepEqual(loops, want) {
+		t.Errorf("walkDir() loops = %q, want %q", loops, want)
+	}
+}
+
+func TestParseByteSize(t *testing.T) {
+	tests := []struct {
+		input string
+		want  int64
+	}{
+		{input: "0", want: 0},
+		{input: "512", want: 512},
+		{input: "10K", want: 10 << 10},
+		{input: "2m", want: 2 << 20},
+		{input: "1GB", want: 1 << 30},
+		{input: "8388607T", want: 8388607 << 40},
+	}
+	for _, test := range tests {
+		got, err := parseByteSize(test.input)
+		if err != nil || got != test.want {
+			t.Errorf("parseByteSize(%q) = %d, %v, want %d", test.input, got, err, test.want)
+		}
+	}
+
+	for _, input := range []string{"", "K", "-1", "10Q", "8388608T", "9000000T"} {
+		_, err := parseByteSize(input)
+		if err == nil {
+			t.Errorf("parseByteSize(%q) expected an error", input)
+		}
+	}
+}
+
+func TestNewerThanSet(t *testing.T) {
+	var n newerThan
+	err := n.Set("1h")
+	if err != nil {
+		t.Fatalf("Set(1h) error = %v", err)
+	}
+	if d := time.Since(n.cutoff); d < time.Hour || d > time.Hour+time.Minute {
+		t.Errorf("Set(1h) cutoff is %s ago, want about 1h", d)
+	}
+
+	err = n.Set("2024-03-01")
+	if err != nil {
+		t.Fatalf("Set(2024-03-01) error = %v", err)
+	}
+	want := time.Date(2024, 3, 1, 0, 0, 0, 0, time.Local)
+	if !n.cutoff.Equal(want) {
+		t.Errorf("Set(2024-03-01) cutoff = %v, want %v", n.cutoff, want)
+	}
+
+	if n.Set("yesterday") == nil {
+		t.Errorf("Set(yesterday) expected an error")
+	}
+}
+
+func TestRecursiveSearchFileInfoFilters(t *testing.T) {
+	countOnly = false
+	before = 0
+	after = 0
+	caseInsensitive = false
+	defer func() {
+		newerThanFlag = newerThan{}
+		maxFileSize, minFileSize = -1, -1
+		maxDepth = -1
+	}()
+
+	tmp := t.TempDir()
+	os.MkdirAll(filepath.Join(tmp, "sub", "deeper"), 0755)
+	small := filepath.Join(tmp, "small.log")
+	big := filepath.Join(tmp, "big.log")
+	old := filepath.Join(tmp, "old.log")
+	nested := filepath.Join(tmp, "sub", "nested.log")
+	deep := filepath.Join(tmp, "sub", "deeper", "deep.log")
+	os.WriteFile(small, []byte("needle\n"), 0644)
+	os.WriteFile(big, []byte("needle\n"+strings.Repeat("x", 2048)+"\n"), 0644)
+	os.WriteFile(old, []byte("needle\n"), 0644)
+	os.WriteFile(nested, []byte("needle\n"), 0644)
+	os.WriteFile(deep, []byte("needle\n"), 0644)
+	lastWeek := time.Now().Add(-7 * 24 * time.Hour)
+	os.Chtimes(old, lastWeek, lastWeek)
+
+	search := func() []string {
+		var buf bytes.Buffer
+		recursiveSearch(context.Background(), "needle", tmp, &buf)
+		var files []string
+		for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+			if line != "" {
+				files = append(files, strings.TrimSuffix(line, ":needle"))
+			}
+		}
+		sort.Strings(files)
+		return files
+	}
+
+	maxFileSize = 1024
+	newerThanFlag.Set("24h")
+	maxDepth = 2
+	got := search()
+	want := []string{small, nested}
+	sort.Strings(want)
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("search() = %q, want %q", got, want)
+	}
+
+	maxFileSize = -1
+	newerThanFlag = newerThan{}
+	minFileSize = 1024
+	maxDepth = -1
+	got = search()
+	want = []string{big}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("search() = %q, want %q", got, want)
+	}
+}
+
+func TestGrepReaderJSONLines(t *testing.T) {
+	countOnly = false
+	before = 0
+	after = 0
+	caseInsensitive = false
+	defer func() {
+		fieldPatterns = nil
+		outputFields = nil
+		jsonlInvalid = invalidJSONSkip
+	}()
+
+	input := `{"level":"error","msg":"db down","ts":"10:00"}
+{"level":"info","msg":"level=error in message"}
+not json level=error
+{"level":"error","ctx":{"codes":[7,42]},"msg":"retry"}
+`
+	var err error
+	fieldPatterns, err = parseFieldPatterns([]string{"level=error"})
+	if err != nil {
+		t.Fatalf("parseFieldPatterns() error = %v", err)
+	}
+
+	tests := []struct {
+		name    string
+		policy  string
+		fields  string
+		want    []string
+		wantErr bool
+	}{
+		{
+			name:   "skip invalid lines",
+			policy: invalidJSONSkip,
+			want: []string{
+				`{"level":"error","msg":"db down","ts":"10:00"}`,
+				`{"level":"error","ctx":{"codes":[7,42]},"msg":"retry"}`,
+			},
+		},
+		{
+			name:   "match invalid lines as raw text",
+			policy: invalidJSONRaw,
+			fields: "msg,ctx.codes.1",
+			want:   []string{`msg="db down"`, "not json level=error", "msg=retry ctx.codes.1=42"},
+		},
+		{
+			name:    "fail on invalid lines",
+			policy:  invalidJSONError,
+			wantErr: true,
+		},
+	}
+
+	for _, test := range tests {
+		jsonlInvalid = test.policy
+		outputFields = parseFieldList(test.fields)
+
+		got, err := grepReader(context.Background(), "", strings.NewReader(input))
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("%s: expected an error", test.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: grepReader() error = %v", test.name, err)
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: grepReader() = %q, want %q", test.name, got, test.want)
+		}
+	}
+
+	_, err = parseFieldPatterns([]string{"level"})
+	if err == nil {
+		t.Errorf("expected error for --jsonl-field without =")
+	}
+}
+
+func TestGrepReaderFieldsContext(t *testing.T) {
+	countOnly = false
+	before = 1
+	after = 1
+	caseInsensitive = false
+	outputFields = parseFieldList("msg")
+	defer func() {
+		before = 0
+		after = 0
+		outputFields = nil
+	}()
+
+	// context lines are projected too, though only matches are projected
+	// as they are matched
+	input := `{"msg":"one"}
+{"msg":"two"}
+{"msg":"three needle"}
+{"msg":"four"}
+{"msg":"five"}
+`
+	got, err := grepReader(context.Background(), "needle", strings.NewReader(input))
+	if err != nil {
+		t.Fatalf("grepReader() error = %v", err)
+	}
+	want := []string{"msg=two", `msg="three needle"`, "msg=four"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("grepReader() = %q, want %q", got, want)
+	}
+}
+
+func TestGrepReaderQuery(t *testing.T) {
+	countOnly = false
+	before = 0
+	after = 0
+	caseInsensitive = true
+	defer func() {
+		queryNode = nil
+		caseInsensitive = false
+	}()
+
+	node, err := query.Parse(`Timeout AND db AND NOT retry`)
+	if err != nil {
+		t.Fatalf("query.Parse() error = %v", err)
+	}
+	queryNode = query.Lower(node)
+
+	input := "db timeout\nDB TIMEOUT, retry 1\ntimeout only\nDB Timeout again\n"
+	got, _ := grepReader(context.Background(), "", strings.NewReader(input))
+	want := []string{"db timeout", "DB Timeout again"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("grepReader() = %q, want %q", got, want)
+	}
+}
+
+func TestFuzzyMatcher(t *testing.T) {
+	tests := []struct {
+		pattern  string
+		maxDist  int
+		line     string
+		wantOK   bool
+		wantSpan fuzzyMatch
+	}{
+		{pattern: "database", maxDist: 1, line: "the databse is down", wantOK: true, wantSpan: fuzzyMatch{start: 4, end: 11, distance: 1}},
+		{pattern: "database", maxDist: 1, line: "the data base", wantOK: true, wantSpan: fuzzyMatch{start: 4, end: 13, distance: 1}},
+		{pattern: "database", maxDist: 1, line: "a database here", wantOK: true, wantSpan: fuzzyMatch{start: 2, end: 10, distance: 0}},
+		{pattern: "database", maxDist: 1, line: "dtabse", wantOK: false},
+		{pattern: "database", maxDist: 2, line: "dtabse", wantOK: true, wantSpan: fuzzyMatch{start: 0, end: 6, distance: 2}},
+		{pattern: "héllo", maxDist: 1, line: "say hello", wantOK: true, wantSpan: fuzzyMatch{start: 4, end: 9, distance: 1}},
+		{pattern: "abc", maxDist: 3, line: "", wantOK: true, wantSpan: fuzzyMatch{start: 0, end: 0, distance: 3}},
+	}
+
+	for _, test := range tests {
+		got, ok := newFuzzyMatcher(test.pattern, test.maxDist).find(test.line)
+		if ok != test.wantOK || (ok && got != test.wantSpan) {
+			t.Errorf("find(%q in %q, %d) = %+v, %v, want %+v, %v", test.pattern, test.line, test.maxDist, got, ok, test.wantSpan, test.wantOK)
+		}
+	}
+}
+
+func TestFuzzyMatcherLongPattern(t *testing.T) {
+	pattern := strings.Repeat("abcdefghij", 7)
+	typo := strings.Replace(pattern, "e", "x", 1)
+	line := "prefix " + typo + " suffix"
+
+	got, ok := newFuzzyMatcher(pattern, 1).find(line)
+	want := fuzzyMatch{start: 7, end: 7 + len(pattern), distance: 1}
+	if !ok || got != want {
+		t.Errorf("find() = %+v, %v, want %+v", got, ok, want)
+	}
+}
+
+func TestFuzzyBitapMatchesSellers(t *testing.T) {
+	words := []string{"err", "error", "eror", "timeout", "tiemout", "db", "dbb", "x"}
+	for _, pattern := range []string{"error", "timeout", "db"} {
+		for k := 0; k <= 2; k++ {
+			matcher := newFuzzyMatcher(pattern, k)
+			for _, a := range words {
+				for _, b := range words {
+					text := []rune(a + " " + b)
+					end1, dist1, ok1 := matcher.bitapEnd(text)
+					end2, dist2, ok2 := matcher.sellersEnd(text)
+					if ok1 != ok2 || end1 != end2 || dist1 != dist2 {
+						t.Errorf("%q k=%d in %q: bitap = %d,%d,%v sellers = %d,%d,%v",
+							pattern, k, string(text), end1, dist1, ok1, end2, dist2, ok2)
+					}
+				}
+			}
+		}
+	}
+}
+
+func TestGrepReaderFuzzy(t *testing.T) {
+	countOnly = false
+	before = 1
+	after = 0
+	caseInsensitive = true
+	defer func() {
+		fuzzyDistance = -1
+		caseInsensitive = false
+		before = 0
+	}()
+	fuzzyDistance = 1
+
+	input := "starting\nTIMEOTU waiting for db\nok\n"
+	got, _ := grepReader(context.Background(), "timeout", strings.NewReader(input))
+	want := []string{"starting", "1-6:1:TIMEOTU waiting for db"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("grepReader() = %q, want %q", got, want)
+	}
+
+	countOnly = true
+	got, _ = grepReader(context.Background(), "timeout", strings.NewReader(input))
+	countOnly = false
+	if !reflect.DeepEqual(got, []string{"1"}) {
+		t.Errorf("grepReader() count = %q, want [1]", got)
+	}
+}
+
+func TestGrepChunksMatchesSequential(t *testing.T) {
+	caseInsensitive = false
+	lineNumbers = true
+	defer func() {
+		lineNumbers = false
+		before, after = 0, 0
+		countOnly = false
+	}()
+
+	var input strings.Builder
+	for i := 0; i < 500; i++ {
+		switch {
+		case i%37 == 0:
+			fmt.Fprintf(&input, "line %d ERROR disk full\n", i)
+		case i%11 == 0:
+			fmt.Fprintf(&input, "line %d %s\n", i, strings.Repeat("long ", 40))
+		default:
+			fmt.Fprintf(&input, "line %d ok\n", i)
+		}
+	}
+	data := input.String() + "ERROR without trailing newline"
+
+	for _, lines := range [][2]int{{0, 0}, {2, 0}, {0, 3}, {4, 4}, {40, 40}} {
+		for _, count := range []bool{false, true} {
+			before, after = lines[0], lines[1]
+			countOnly = count
+
+			want, err := grepReader(t.Context(), "ERROR", strings.NewReader(data))
+			if err != nil {
+				t.Fatalf("grepReader() error = %v", err)
+			}
+			for n := 1; n <= 16; n++ {
+				got, err := grepChunks(t.Context(), "ERROR", strings.NewReader(data), int64(len(data)), n)
+				if err != nil {
+					t.Fatalf("grepChunks() error = %v", err)
+				}
+				if !reflect.DeepEqual(got, want) {
+					t.Errorf("-B %d -A %d -c=%v with %d chunks:\ngot  %q\nwant %q", before, after, countOnly, n, got, want)
+				}
+			}
+		}
+	}
+}
+
+func TestChunkBoundaries(t *testing.T) {
+	data := "aaaa\nbbbbbbbbbbbbbbbbbbbbbbbb\ncc\nd"
+	bounds, err := chunkBoundaries(strings.NewReader(data), int64(len(data)), 4)
+	if err != nil {
+		t.Fatalf("chunkBoundaries() error = %v", err)
+	}
+
+	if bounds[0] != 0 || bounds[len(bounds)-1] != int64(len(data)) {
+		t.Fatalf("chunkBoundaries() = %v, want to span 0..%d", bounds, len(data))
+	}
+	for _, b := range bounds[1 : len(bounds)-1] {
+		if data[b-1] != '\n' {
+			t.Errorf("boundary %d does not start a line in %v", b, bounds)
+		}
+	}
+}
+
+func TestGrepFileChunksFromCurrentOffset(t *testing.T) {
+	caseInsensitive = false
+	lineNumbers = true
+	noMmap = true
+	threshold := parallelChunkThreshold
+	parallelChunkThreshold = 1
+	procs := runtime.GOMAXPROCS(4)
+	defer func() {
+		lineNumbers = false
+		noMmap = false
+		parallelChunkThreshold = threshold
+		runtime.GOMAXPROCS(procs)
+	}()
+
+	path := filepath.Join(t.TempDir(), "input.txt")
+	data := "ERROR already read\nok\nERROR one\nok\nERROR two\n"
+	if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	// as stdin is left by `(head -n 1; mygrep ERROR) < input.txt`
+	if _, err := file.Seek(int64(len("ERROR already read\n")), io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	got, err := grepFile(t.Context(), "ERROR", file)
+	if err != nil {
+		t.Fatalf("grepFile() error = %v", err)
+	}
+	want := []string{"2:ERROR one", "4:ERROR two"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("grepFile() = %q, want %q", got, want)
+	}
+}
+
+func writeBenchmarkLog(b *testing.B) (*os.File, int64) {
+	b.Helper()
+
+	path := filepath.Join(b.TempDir(), "huge.log")
+	file, err := os.Create(path)
+	if err != nil {
+		b.Fatal(err)
+	}
+	writer := bufio.NewWriter(file)
+	var written int
+	for i := 0; written < 64<<20; i++ {
+		var n int
+		if i%1000 == 0 {
+			n, _ = fmt.Fprintf(writer, "2025-05-19T10:00:00Z level=error request %d failed: connection reset\n", i)
+		} else {
+			n, _ = fmt.Fprintf(writer, "2025-05-19T10:00:00Z level=info request %d served in 12ms\n", i)
+		}
+		written += n
+	}
+	writer.Flush()
+	b.Cleanup(func() { file.Close() })
+
+	return file, int64(written)
+}
+
+func BenchmarkGrepSequential(b *testing.B) {
+	countOnly, before, after, caseInsensitive = true, 0, 0, false
+	defer func() { countOnly = false }()
+	file, size := writeBenchmarkLog(b)
+
+	b.SetBytes(size)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		file.Seek(0, io.SeekStart)
+		grepReader(context.Background(), "connection reset", file)
+	}
+}
+
+func BenchmarkGrepChunked(b *testing.B) {
+	countOnly, before, after, caseInsensitive = true, 0, 0, false
+	defer func() { countOnly = false }()
+	file, size := writeBenchmarkLog(b)
+
+	b.SetBytes(size)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		grepChunks(context.Background(), "connection reset", file, size, runtime.GOMAXPROCS(0))
+	}
+}
+
+func TestReadFileList(t *testing.T) {
+	got, err := readFileList(strings.NewReader("a b.txt\x00dir/c:d.log\x00\x00last"), 0)
+	want := []string{"a b.txt", "dir/c:d.log", "last"}
+	if err != nil || !reflect.DeepEqual(got, want) {
+		t.Errorf("readFileList(NUL) = %q, %v, want %q", got, err, want)
+	}
+
+	got, err = readFileList(strings.NewReader("one.txt\r\n\ntwo.txt\n"), '\n')
+	want = []string{"one.txt", "two.txt"}
+	if err != nil || !reflect.DeepEqual(got, want) {
+		t.Errorf("readFileList(newline) = %q, %v, want %q", got, err, want)
+	}
+}
+
+func TestSearchFileListNullSeparated(t *testing.T) {
+	countOnly = false
+	before, after = 0, 0
+	caseInsensitive = false
+	nullSeparated = true
+	defer func() { nullSeparated = false }()
+
+	tmp := t.TempDir()
+	spaced := filepath.Join(tmp, "with space:colon.txt")
+	plain := filepath.Join(tmp, "plain.txt")
+	os.WriteFile(spaced, []byte("needle one\n"), 0644)
+	os.WriteFile(plain, []byte("needle two\nhay\n"), 0644)
+
+	var buf bytes.Buffer
+	ok, err := searchFileList(context.Background(), "needle", []string{spaced, filepath.Join(tmp, "missing.txt"), plain}, &buf)
+	if err != nil {
+		t.Fatalf("searchFileList() error = %v", err)
+	}
+	if ok {
+		t.Errorf("searchFileList() ok = true, want false for a missing file")
+	}
+
+	want := spaced + "\x00needle one\n" + plain + "\x00needle two\n"
+	if buf.String() != want {
+		t.Errorf("searchFileList() output = %q, want %q", buf.String(), want)
+	}
+}
+
+var update = flag.Bool("update", false, "rewrite golden files in testdata")
+
+func TestGeneratedDocsGolden(t *testing.T) {
+	t.Setenv("SOURCE_DATE_EPOCH", "1747612800")
+
+	tests := []struct {
+		golden   string
+		generate func(w io.Writer) error
+	}{
+		{golden: "mygrep.1.golden", generate: writeManPage},
+	}
+	for _, shell := range []string{"bash", "zsh", "fish", "powershell"} {
+		tests = append(tests, struct {
+			golden   string
+			generate func(w io.Writer) error
+		}{
+			golden:   "completion." + shell + ".golden",
+			generate: func(w io.Writer) error { return writeCompletion(w, shell) },
+		})
+	}
+
+	for _, test := range tests {
+		var buf bytes.Buffer
+		err := test.generate(&buf)
+		if err != nil {
+			t.Fatalf("%s: generate error = %v", test.golden, err)
+		}
+
+		path := filepath.Join("testdata", test.golden)
+		if *update {
+			os.WriteFile(path, buf.Bytes(), 0644)
+			continue
+		}
+
+		want, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatalf("%s: %v (run go test ./cmd/ -update to create it)", test.golden, err)
+		}
+		if !bytes.Equal(buf.Bytes(), want) {
+			t.Errorf("%s is out of date; run go test ./cmd/ -run GeneratedDocs -update and review the diff", path)
+		}
+	}
+
+	if writeCompletion(io.Discard, "tcsh") == nil {
+		t.Errorf("expected an error for an unsupported shell")
+	}
+}
+
+func TestIsSubcommand(t *testing.T) {
+	tests := []struct {
+		args []string
+		want bool
+	}{
+		{args: []string{"man"}, want: true},
+		{args: []string{"completion", "zsh"}, want: true},
+		{args: []string{"__complete", "--ty"}, want: true},
+		{args: []string{"hello", "file.txt"}, want: false},
+		{args: []string{"-i", "hello"}, want: false},
+		{args: []string{}, want: false},
+	}
+	for _, test := range tests {
+		if got := isSubcommand(test.args); got != test.want {
+			t.Errorf("isSubcommand(%q) = %v, want %v", test.args, got, test.want)
+		}
+	}
+}
+
+func TestParseKeys(t *testing.T) {
+	got := parseKeys([]byte("aé\t\x7f\r\x1b[A\x1b[B\x1bOA\x1b[5~\x1b[6~\x0e\x10\x14\x15\x03\x1b"))
+	want := []key{
+		{code: keyRune, r: 'a'},
+		{code: keyRune, r: 'é'},
+		{code: keyTab},
+		{code: keyBackspace},
+		{code: keyEnter},
+		{code: keyUp},
+		{code: keyDown},
+		{code: keyUp},
+		{code: keyPageUp},
+		{code: keyPageDown},
+		{code: keyDown},
+		{code: keyUp},
+		{code: keyToggleCase},
+		{code: keyClear},
+		{code: keyQuit},
+		{code: keyQuit},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("parseKeys() = %v, want %v", got, want)
+	}
+}
+
+func TestTUIRender(t *testing.T) {
+	tmp := t.TempDir()
+	path := filepath.Join(tmp, "a.txt")
+	os.WriteFile(path, []byte("one\ntwo needle\nthree\nfour needle\nfive\n"), 0644)
+
+	ui := newTUI(tmp)
+	ui.inputs[inputPattern] = []rune("needle")
+	ui.hits = []searchHit{
+		{path: path, line: 2, text: "two needle"},
+		{path: path, line: 4, text: "four needle"},
+	}
+	ui.files = 1
+	ui.moveSelection(1)
+
+	lines := ui.render(120, 8)
+	if len(lines) != 8 {
+		t.Fatalf("render() returned %d lines, want 8", len(lines))
+	}
+	if !strings.HasPrefix(lines[0], "[Search: needle_]") {
+		t.Errorf("header = %q, want the focused search field first", lines[0])
+	}
+	if lines[1] != "2 matches in 1 files" {
+		t.Errorf("status = %q", lines[1])
+	}
+	if !strings.HasPrefix(lines[3], "  "+path+":2: two needle") {
+		t.Errorf("first row = %q", lines[3])
+	}
+	if !strings.HasPrefix(lines[4], "> "+path+":4: four needle") {
+		t.Errorf("selected row = %q", lines[4])
+	}
+	if !strings.Contains(lines[5], ">    4  four needle") {
+		t.Errorf("preview does not mark the selected line:\n%s", strings.Join(lines, "\n"))
+	}
+	for i, line := range lines {
+		if n := len([]rune(line)); n > 120 {
+			t.Errorf("line %d is %d characters wide", i, n)
+		}
+	}
+
+	if got := ui.render(10, 3); len(got) != 1 {
+		t.Errorf("render() of a tiny terminal = %q", got)
+	}
+}
+
+func TestTUIRenderControlCharacters(t *testing.T) {
+	tmp := t.TempDir()
+	path := filepath.Join(tmp, "a.txt")
+	line := "\x1b[2J\x1b]0;pwned\x07needle\u009b31m\x7f\rend"
+	os.WriteFile(path, []byte(line+"\n"), 0644)
+
+	ui := newTUI(tmp)
+	ui.inputs[inputPattern] = []rune("needle")
+	ui.hits = []searchHit{{path: path, line: 1, text: line}}
+	ui.files = 1
+
+	frame := strings.Join(ui.render(200, 6), "\n")
+	if strings.ContainsAny(frame, "\x1b\x07\x7f\r\u009b") {
+		t.Errorf("render() passed control characters through:\n%q", frame)
+	}
+	// both the result row and the preview show the line with them replaced
+	if want := "?[2J?]0;pwned?needle?31m??end"; strings.Count(frame, want) != 2 {
+		t.Errorf("render() = %q, want %q in the row and the preview", frame, want)
+	}
+}
+
+func TestTUIFitWidth(t *testing.T) {
+	// wide characters take two columns, so only two of them fit in five
+	if got := fit("日本語abc", 5); got != "日本" {
+		t.Errorf("fit() = %q, want %q", got, "日本")
+	}
+	if got := fit("a日本", 5); got != "a日本" {
+		t.Errorf("fit() = %q, want %q", got, "a日本")
+	}
+	if got := pad("日本", 6); got != "日本  " {
+		t.Errorf("pad() = %q, want %q", got, "日本  ")
+	}
+}
+
+func TestTUIApplyBatchLimit(t *testing.T) {
+	ui := newTUI(t.TempDir())
+	ui.hits = make([]searchHit, maxTUIHits-1)
+	ui.applyBatch(hitBatch{hits: make([]searchHit, 5)})
+	if len(ui.hits) != maxTUIHits || ui.files != 1 {
+		t.Errorf("after the limit: %d hits in %d files, want %d in 1", len(ui.hits), ui.files, maxTUIHits)
+	}
+
+	// a batch queued before the search stopped adds neither hits nor files
+	ui.applyBatch(hitBatch{hits: make([]searchHit, 5)})
+	if len(ui.hits) != maxTUIHits || ui.files != 1 {
+		t.Errorf("past the limit: %d hits in %d files, want %d in 1", len(ui.hits), ui.files, maxTUIHits)
+	}
+}
+
+func TestTUIFileHitsPreprocessor(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("needs a POSIX shell")
+	}
+	caseInsensitive = false
+	lineNumbers = true
+	preCommand = writePreprocessor(t)
+	defer func() {
+		lineNumbers = false
+		preCommand = ""
+	}()
+
+	path := filepath.Join(t.TempDir(), "a.txt")
+	os.WriteFile(path, []byte("needle: one\nhay\nneedle\n"), 0644)
+
+	got := fileHits(context.Background(), path, "NEEDLE")
+	want := []searchHit{
+		{path: path, line: 1, text: "NEEDLE: ONE"},
+		{path: path, line: 3, text: "NEEDLE"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("fileHits() = %+v, want %+v", got, want)
+	}
+}
+
+// frameRecorder stands in for the terminal, keeping every frame drawn.
+type frameRecorder struct {
+	mu  sync.Mutex
+	buf strings.Builder
+}
+
+func (r *frameRecorder) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.buf.Write(p)
+}
+
+func (r *frameRecorder) lastFrame() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	frames := strings.Split(r.buf.String(), clearScreen)
+	return frames[len(frames)-1]
+}
+
+func (r *frameRecorder) waitFor(t *testing.T, text string) string {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		frame := r.lastFrame()
+		if strings.Contains(frame, text) {
+			return frame
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %q, last frame:\n%s", text, frame)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestTUISession(t *testing.T) {
+	countOnly = false
+	before = 0
+	after = 0
+	defer func() {
+		caseInsensitive = false
+		typeFilter = nil
+		lineNumbers = false
+	}()
+
+	tmp := t.TempDir()
+	os.WriteFile(filepath.Join(tmp, "a.go"), []byte("package a\n// Needle here\n"), 0644)
+	os.WriteFile(filepath.Join(tmp, "b.txt"), []byte("x\ny\nneedle\n"), 0644)
+
+	type opened struct {
+		path string
+		line int64
+	}
+	edits := make(chan opened, 1)
+
+	ui := newTUI(tmp)
+	ui.size = func() (int, int) { return 100, 12 }
+	ui.openEditor = func(path string, line int64) error {
+		edits <- opened{path, line}
+		return nil
+	}
+
+	in, keys := io.Pipe()
+	screen := &frameRecorder{}
+	done := make(chan error, 1)
+	go func() { done <- ui.run(context.Background(), in, screen) }()
+	defer keys.Close()
+
+	screen.waitFor(t, "type to search")
+	keys.Write([]byte("needle"))
+	screen.waitFor(t, "1 matches in 1 files\r\n")
+
+	// ignore case picks up the Go file too
+	keys.Write([]byte{0x14})
+	screen.waitFor(t, "2 matches in 2 files\r\n")
+
+	// restricting to Go files leaves only the capitalised match
+	keys.Write([]byte("\tgo"))
+	frame := screen.waitFor(t, "1 matches in 1 files\r\n")
+	if !strings.Contains(frame, "> "+filepath.Join(tmp, "a.go")+":2:") {
+		t.Fatalf("expected the Go match, frame:\n%s", frame)
+	}
+
+	keys.Write([]byte("\x7f\x7f"))
+	screen.waitFor(t, "2 matches in 2 files\r\n")
+	keys.Write([]byte("\x1b[B\r"))
+	select {
+	case edit := <-edits:
+		if edit.line < 2 || !strings.HasPrefix(edit.path, tmp) {
+			t.Errorf("opened %s:%d", edit.path, edit.line)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Enter did not open the editor")
+	}
+
+	keys.Write([]byte{0x03})
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("run() error = %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Ctrl-C did not quit")
+	}
+}
+
+// TestMain lets the serve tests run this test binary as the mygrep process
+// that answers each search.
+func TestMain(m *testing.M) {
+	if os.Getenv("MYGREP_TEST_SEARCH_PROCESS") == "1" {
+		Execute()
+	}
+	os.Exit(m.Run())
+}
+
+func newTestSearchServer(t *testing.T, root string) *searchServer {
+	t.Helper()
+	s, err := newSearchServer(root, 2, 10*time.Second)
+	if err != nil {
+		t.Fatalf("newSearchServer() error = %v", err)
+	}
+	s.executable = os.Args[0]
+	s.env = append(os.Environ(), "MYGREP_TEST_SEARCH_PROCESS=1")
+	return s
+}
+
+func decodeSearchEvents(t *testing.T, body io.Reader) []searchEvent {
+	t.Helper()
+	var events []searchEvent
+	decoder := json.NewDecoder(body)
+	for decoder.More() {
+		var event searchEvent
+		if err := decoder.Decode(&event); err != nil {
+			t.Fatalf("decoding NDJSON: %v", err)
+		}
+		events = append(events, event)
+	}
+	return events
+}
+
+func writeServeTree(t *testing.T) string {
+	t.Helper()
+	root := t.TempDir()
+	os.MkdirAll(filepath.Join(root, "logs"), 0755)
+	os.WriteFile(filepath.Join(root, "logs", "app.log"), []byte("start\nERROR disk full\nretry\nerror: again\n"), 0644)
+	os.WriteFile(filepath.Join(root, "notes.txt"), []byte("no errors here\n"), 0644)
+	return root
+}
+
+func TestServeSearchNDJSON(t *testing.T) {
+	server := httptest.NewServer(newTestSearchServer(t, writeServeTree(t)))
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/search?q=error&i=true&path=logs&B=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d", resp.StatusCode)
+	}
+	if got := resp.Header.Get("Content-Type"); got != "application/x-ndjson" {
+		t.Errorf("Content-Type = %q", got)
+	}
+
+	var got []string
+	for _, event := range decodeSearchEvents(t, resp.Body) {
+		switch event.Type {
+		case "match", "context":
+			got = append(got, fmt.Sprintf("%s %s:%d:%s", event.Type, event.Path, event.Line, *event.Text))
+		default:
+			got = append(got, event.Type+" "+event.Status)
+		}
+	}
+	logPath := filepath.Join("logs", "app.log")
+	want := []string{
+		"context " + logPath + ":1:start",
+		"match " + logPath + ":2:ERROR disk full",
+		"context " + logPath + ":3:retry",
+		"match " + logPath + ":4:error: again",
+		"end ok",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("events = %q, want %q", got, want)
+	}
+}
+
+func TestServeSearchSSEAndCount(t *testing.T) {
+	server := httptest.NewServer(newTestSearchServer(t, writeServeTree(t)))
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/search?q=error&c&format=sse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+
+	if got := resp.Header.Get("Content-Type"); got != "text/event-stream" {
+		t.Errorf("Content-Type = %q", got)
+	}
+	for _, want := range []string{
+		`event: count` + "\n" + `data: {"type":"count","path":"` + filepath.Join("logs", "app.log") + `","count":1}` + "\n\n",
+		`event: count` + "\n" + `data: {"type":"count","path":"notes.txt","count":1}` + "\n\n",
+		`event: end` + "\n" + `data: {"type":"end","status":"ok"}` + "\n\n",
+	} {
+		if !strings.Contains(string(body), want) {
+			t.Errorf("body missing %q:\n%s", want, body)
+		}
+	}
+}
+
+func TestServeSearchRejectsBadRequests(t *testing.T) {
+	root := writeServeTree(t)
+	outside := t.TempDir()
+	os.WriteFile(filepath.Join(outside, "secret"), []byte("error\n"), 0644)
+	os.Symlink(outside, filepath.Join(root, "escape"))
+
+	server := httptest.NewServer(newTestSearchServer(t, root))
+	defer server.Close()
+
+	tests := []struct {
+		query   string
+		wantErr string
+	}{
+		{query: "q=error&path=../", wantErr: "not inside"},
+		{query: "q=error&path=" + url.QueryEscape(outside), wantErr: "not inside"},
+		{query: "q=error&path=escape", wantErr: "not inside"},
+		{query: "q=error&path=missing", wantErr: "not found"},
+		{query: "q=error&out=/tmp/x", wantErr: "unsupported parameter"},
+		{query: "q=error&files-from=/etc/passwd", wantErr: "unsupported parameter"},
+		{query: "q=error&L=true", wantErr: "unsupported parameter"},
+		{query: "q=error&i=maybe", wantErr: "want true or false"},
+		{query: "q=error&count=true&c=false", wantErr: "conflicting values for count"},
+		{query: "path=logs", wantErr: "missing q"},
+		{query: "q=error&timeout=soon", wantErr: "invalid timeout"},
+		{query: "q=error&format=xml", wantErr: "invalid format"},
+		{query: "q=error&max-depth=deep", wantErr: "invalid argument"},
+		{query: "query=" + url.QueryEscape("a AND"), wantErr: "invalid query"},
+	}
+	for _, test := range tests {
+		resp, err := http.Get(server.URL + "/search?" + test.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		if resp.StatusCode != http.StatusBadRequest || !strings.Contains(string(body), test.wantErr) {
+			t.Errorf("%s: got %d %s, want 400 containing %q", test.query, resp.StatusCode, body, test.wantErr)
+		}
+	}
+}
+
+func TestServeSearchUnreadableFile(t *testing.T) {
+	root := writeServeTree(t)
+	// a socket can't be opened, even by root, for whom permissions don't apply
+	listener, err := net.Listen("unix", filepath.Join(root, "s.sock"))
+	if err != nil {
+		t.Skipf("cannot create a socket: %v", err)
+	}
+	defer listener.Close()
+
+	server := httptest.NewServer(newTestSearchServer(t, root))
+	defer server.Close()
+
+	for _, test := range []struct {
+		query       string
+		wantMatches int
+	}{
+		{query: "q=error&i=true", wantMatches: 3},
+		{query: "q=nowhere", wantMatches: 0},
+	} {
+		resp, err := http.Get(server.URL + "/search?" + test.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != http.StatusOK {
+			body, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			t.Errorf("%s: status = %d %s, want 200", test.query, resp.StatusCode, body)
+			continue
+		}
+		events := decodeSearchEvents(t, resp.Body)
+		resp.Body.Close()
+
+		matches := 0
+		for _, event := range events {
+			if event.Type == "match" {
+				matches++
+			}
+		}
+		end := events[len(events)-1]
+		if matches != test.wantMatches || end.Status != "ok" || len(end.Warnings) != 1 || !strings.Contains(end.Warnings[0], "s.sock") {
+			t.Errorf("%s: %d matches ending %+v, want %d ending ok with a warning about s.sock", test.query, matches, end, test.wantMatches)
+		}
+	}
+}
+
+func TestServeSearchLimits(t *testing.T) {
+	s := newTestSearchServer(t, writeServeTree(t))
+	server := httptest.NewServer(s)
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/search?q=error&timeout=1ns")
+	if err != nil {
+		t.Fatal(err)
+	}
+	events := decodeSearchEvents(t, resp.Body)
+	resp.Body.Close()
+	if last := events[len(events)-1]; last.Type != "end" || last.Status != "timeout" {
+		t.Errorf("last event = %+v, want a timeout", last)
+	}
+
+	// occupy every slot so the next search is turned away
+	for range cap(s.slots) {
+		s.slots <- struct{}{}
+	}
+	resp, err = http.Get(server.URL + "/search?q=error")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable || resp.Header.Get("Retry-After") == "" {
+		t.Errorf("status = %d, want 503 with Retry-After", resp.StatusCode)
+	}
+
+	resp, err = http.Post(server.URL+"/search?q=error", "text/plain", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("POST status = %d, want 405", resp.StatusCode)
+	}
+}
+
+const countByLog = `2025-05-19T10:00:05Z ERROR code=E1001 disk full
+2025-05-19T10:00:45Z ERROR code=E2002 timeout
+2025-05-19 10:03:01.250 ERROR code=E1001 disk full
+2025-05-19T10:03:30Z INFO code=E1001 recovered
+ERROR without a code or time
+`
+
+func TestGrepReaderCountBy(t *testing.T) {
+	countOnly = false
+	caseInsensitive = false
+	defer func() {
+		groupKey = nil
+		groups = &matchGroups{}
+	}()
+
+	tests := []struct {
+		name    string
+		countBy string
+		bucket  time.Duration
+		want    []groupRow
+	}{
+		{
+			name:    "capture group",
+			countBy: `code=(E\d+)`,
+			want:    []groupRow{{"E1001", 2}, {"E2002", 1}, {noGroupKey, 1}},
+		},
+		{
+			name:    "whole match without groups",
+			countBy: `disk full|timeout`,
+			want:    []groupRow{{"disk full", 2}, {"timeout", 1}, {noGroupKey, 1}},
+		},
+		{
+			name:   "minute buckets",
+			bucket: time.Minute,
+			want: []groupRow{
+				{"2025-05-19T10:00:00Z", 2},
+				{"2025-05-19T10:01:00Z", 0},
+				{"2025-05-19T10:02:00Z", 0},
+				{"2025-05-19T10:03:00Z", 1},
+				{noGroupKey, 1},
+			},
+		},
+		{
+			name:    "buckets of a captured timestamp",
+			countBy: `^(\S+)`,
+			bucket:  time.Hour,
+			want:    []groupRow{{"2025-05-19T10:00:00Z", 2}, {noGroupKey, 2}},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var err error
+			groups = &matchGroups{}
+			groupKey, err = newGroupKeyer(test.countBy, test.bucket)
+			if err != nil {
+				t.Fatalf("newGroupKeyer() error = %v", err)
+			}
+
+			matches, err := grepReader(context.Background(), "ERROR", strings.NewReader(countByLog))
+			if err != nil {
+				t.Fatalf("grepReader() error = %v", err)
+			}
+			if len(matches) != 0 {
+				t.Errorf("grepReader() printed %q, want nothing while aggregating", matches)
+			}
+			if got := groups.rows(test.bucket); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("rows = %v, want %v", got, test.want)
+			}
+		})
+	}
+
+	if _, err := newGroupKeyer("(", 0); err == nil {
+		t.Errorf("expected an error for an invalid --count-by regex")
+	}
+}
+
+func TestWriteGroups(t *testing.T) {
+	defer func() { histogram = false }()
+	rows := []groupRow{{"E1001", 120}, {"E2002", 30}, {"E3", 0}}
+
+	var buf bytes.Buffer
+	writeGroups(&buf, rows)
+	want := "COUNT  KEY\n  120  E1001\n   30  E2002\n    0  E3\n"
+	if buf.String() != want {
+		t.Errorf("table =\n%s\nwant\n%s", buf.String(), want)
+	}
+
+	histogram = true
+	buf.Reset()
+	writeGroups(&buf, rows)
+	want = "E1001  120 " + strings.Repeat("#", histogramWidth) + "\n" +
+		"E2002   30 " + strings.Repeat("#", histogramWidth/4) + "\n" +
+		"E3       0\n"
+	if buf.String() != want {
+		t.Errorf("histogram =\n%s\nwant\n%s", buf.String(), want)
+	}
+}
+
+// writePreprocessor writes a shell script that upper-cases its input, fails
+// for *.bad files and hangs for *.slow files.
+func writePreprocessor(t *testing.T) string {
+	t.Helper()
+	script := filepath.Join(t.TempDir(), "pre.sh")
+	os.WriteFile(script, []byte(`#!/bin/sh
+case "$1" in
+*.bad) echo "cannot convert $1" >&2; exit 3 ;;
+*.slow) exec sleep 10 ;;
+esac
+tr a-z A-Z
+`), 0755)
+	return script
+}
+
+func TestGrepFilePreprocessor(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("needs a POSIX shell")
+	}
+	countOnly = false
+	caseInsensitive = false
+	preCommand = writePreprocessor(t)
+	preTimeout = 200 * time.Millisecond
+	defer func() {
+		preCommand = ""
+		preGlobs = nil
+		preTimeout = 30 * time.Second
+	}()
+
+	tmp := t.TempDir()
+	write := func(name string) *os.File {
+		path := filepath.Join(tmp, name)
+		os.WriteFile(path, []byte("needle one\nhaystack\n"), 0644)
+		file, err := os.Open(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { file.Close() })
+		return file
+	}
+
+	matches, err := grepFile(context.Background(), "NEEDLE", write("doc.pdf"))
+	if err != nil || !reflect.DeepEqual(matches, []string{"NEEDLE ONE"}) {
+		t.Errorf("grepFile() = %q, %v; want the converted line", matches, err)
+	}
+
+	_, err = grepFile(context.Background(), "NEEDLE", write("doc.bad"))
+	if err == nil || !strings.Contains(err.Error(), "exit status 3: cannot convert") {
+		t.Errorf("grepFile() error = %v, want the converter's failure", err)
+	}
+
+	start := time.Now()
+	_, err = grepFile(context.Background(), "NEEDLE", write("doc.slow"))
+	if err == nil || !strings.Contains(err.Error(), "timed out after 200ms") || isCanceled(err) {
+		t.Errorf("grepFile() error = %v, want a per-file timeout", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("timed out converter took %s to stop", elapsed)
+	}
+
+	// files not matching --pre-glob are searched as they are
+	preGlobs = []string{"*.pdf", "!secret.*"}
+	matches, err = grepFile(context.Background(), "needle", write("notes.txt"))
+	if err != nil || !reflect.DeepEqual(matches, []string{"needle one"}) {
+		t.Errorf("grepFile() = %q, %v; want the raw line", matches, err)
+	}
+	if usePreprocessor("secret.pdf") || !usePreprocessor("dir/report.pdf") {
+		t.Errorf("usePreprocessor() ignored --pre-glob")
+	}
+}
+
+func TestRecursiveSearchPreprocessorErrorsPerFile(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("needs a POSIX shell")
+	}
+	countOnly = false
+	caseInsensitive = false
+	preCommand = writePreprocessor(t)
+	defer func() { preCommand = "" }()
+
+	tmp := t.TempDir()
+	os.WriteFile(filepath.Join(tmp, "a.txt"), []byte("needle\n"), 0644)
+	os.WriteFile(filepath.Join(tmp, "b.bad"), []byte("needle\n"), 0644)
+
+	var buf bytes.Buffer
+	if _, err := recursiveSearch(context.Background(), "NEEDLE", tmp, &buf); err != nil {
+		t.Fatalf("recursiveSearch() error = %v", err)
+	}
+	want := filepath.Join(tmp, "a.txt") + ":NEEDLE\n"
+	if buf.String() != want {
+		t.Errorf("recursiveSearch() = %q, want %q", buf.String(), want)
+	}
+}
+
+// newGitRepo creates a repository with one commit tagged v1 holding
+// a.txt and sub/b.go, then edits sub/b.go and adds c.txt without committing.
+func newGitRepo(t *testing.T) string {
+	t.Helper()
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not installed")
+	}
+
+	dir := t.TempDir()
+	git := func(args ...string) {
+		t.Helper()
+		cmd := exec.Command("git", args...)
+		cmd.Dir = dir
+		cmd.Env = append(os.Environ(), "GIT_CONFIG_GLOBAL=/dev/null", "GIT_CONFIG_NOSYSTEM=1")
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("git %v: %v\n%s", args, err, out)
+		}
+	}
+
+	git("init", "-q")
+	git("config", "user.email", "test@example.com")
+	git("config", "user.name", "Test")
+	os.MkdirAll(filepath.Join(dir, "sub"), 0755)
+	os.WriteFile(filepath.Join(dir, "a.txt"), []byte("needle in a\n"), 0644)
+	os.WriteFile(filepath.Join(dir, "sub", "b.go"), []byte("// old needle\n"), 0644)
+	git("add", ".")
+	git("commit", "-q", "-m", "initial")
+	git("tag", "v1")
+
+	os.WriteFile(filepath.Join(dir, "sub", "b.go"), []byte("// new needle\n"), 0644)
+	os.WriteFile(filepath.Join(dir, "c.txt"), []byte("needle in c\n"), 0644)
+	git("add", "c.txt")
+	return dir
+}
+
+func TestGitChangedTakesSeparateBase(t *testing.T) {
+	dir := newGitRepo(t)
+
+	// --git-changed needs its BASE, so the word after it isn't taken as
+	// the search string
+	cmd := exec.Command(os.Args[0], "--no-config", "--git-changed", "HEAD", "needle", dir)
+	cmd.Env = append(os.Environ(), "MYGREP_TEST_SEARCH_PROCESS=1")
+	out, err := cmd.Output()
+	if err != nil {
+		t.Fatalf("mygrep --git-changed HEAD needle error = %v", err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(out)), "\n")
+	sort.Strings(lines)
+	want := []string{
+		filepath.Join(dir, "c.txt") + ":needle in c",
+		filepath.Join(dir, "sub", "b.go") + ":// new needle",
+	}
+	if !reflect.DeepEqual(lines, want) {
+		t.Errorf("mygrep --git-changed HEAD needle = %q, want %q", lines, want)
+	}
+}
+
+func TestRecursiveSearchGitChanged(t *testing.T) {
+	countOnly = false
+	caseInsensitive = false
+	defer func() { changedFiles = nil }()
+
+	dir := newGitRepo(t)
+	var err error
+	changedFiles, err = newGitChangedFilter(context.Background(), dir, "HEAD")
+	if err != nil {
+		t.Fatalf("newGitChangedFilter() error = %v", err)
+	}
+
+	var buf bytes.Buffer
+	recursiveSearch(context.Background(), "needle", dir, &buf)
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	sort.Strings(lines)
+	want := []string{
+		filepath.Join(dir, "c.txt") + ":needle in c",
+		filepath.Join(dir, "sub", "b.go") + ":// new needle",
+	}
+	if !reflect.DeepEqual(lines, want) {
+		t.Errorf("recursiveSearch() = %q, want %q", lines, want)
+	}
+
+	// searching a subdirectory still matches paths from the repository top
+	sub := filepath.Join(dir, "sub")
+	changedFiles, err = newGitChangedFilter(context.Background(), sub, "HEAD")
+	if err != nil {
+		t.Fatalf("newGitChangedFilter() error = %v", err)
+	}
+	buf.Reset()
+	recursiveSearch(context.Background(), "needle", sub, &buf)
+	if want := filepath.Join(sub, "b.go") + ":// new needle\n"; buf.String() != want {
+		t.Errorf("recursiveSearch() = %q, want %q", buf.String(), want)
+	}
+
+	if _, err := newGitChangedFilter(context.Background(), dir, "no-such-rev"); err == nil {
+		t.Errorf("expected an error for an unknown base revision")
+	}
+}
+
+func TestGitRevSearch(t *testing.T) {
+	countOnly = false
+	caseInsensitive = false
+	lineNumbers = true
+	defer func() {
+		lineNumbers = false
+		typeFilter = nil
+	}()
+
+	dir := newGitRepo(t)
+
+	var buf bytes.Buffer
+	if err := gitRevSearch(context.Background(), "needle", "v1", dir, &buf); err != nil {
+		t.Fatalf("gitRevSearch() error = %v", err)
+	}
+	want := "v1:a.txt:1:needle in a\nv1:sub/b.go:1:// old needle\n"
+	if buf.String() != want {
+		t.Errorf("gitRevSearch() = %q, want %q", buf.String(), want)
+	}
+
+	registry, _ := newTypeRegistry(nil)
+	typeFilter, _ = newFileTypeFilter(registry, []string{"go"}, nil)
+	buf.Reset()
+	gitRevSearch(context.Background(), "needle", "v1", filepath.Join(dir, "sub"), &buf)
+	if want := "v1:sub/b.go:1:// old needle\n"; buf.String() != want {
+		t.Errorf("gitRevSearch() of a subdirectory = %q, want %q", buf.String(), want)
+	}
+
+	err := gitRevSearch(context.Background(), "needle", "no-such-rev", dir, &buf)
+	if err == nil || !strings.Contains(err.Error(), "git ls-tree") {
+		t.Errorf("gitRevSearch() error = %v, want git's complaint about the revision", err)
+	}
+}
+
+func TestRecursiveSearchSortAndHeading(t *testing.T) {
+	countOnly = false
+	caseInsensitive = false
+	defer func() {
+		sortBy = ""
+		sortReverse = ""
+		heading = false
+	}()
+
+	tmp := t.TempDir()
+	base := time.Date(2025, 5, 1, 12, 0, 0, 0, time.UTC)
+	files := []struct {
+		name     string
+		modified time.Duration
+		accessed time.Duration
+	}{
+		{name: "b.txt", modified: 3 * time.Hour, accessed: 1 * time.Hour},
+		{name: "a-c.txt", modified: 1 * time.Hour, accessed: 2 * time.Hour},
+		{name: filepath.Join("a", "z.txt"), modified: 2 * time.Hour, accessed: 3 * time.Hour},
+	}
+	os.Mkdir(filepath.Join(tmp, "a"), 0755)
+	for _, file := range files {
+		path := filepath.Join(tmp, file.name)
+		os.WriteFile(path, []byte("needle\n"), 0644)
+		os.Chtimes(path, base.Add(file.accessed), base.Add(file.modified))
+	}
+
+	search := func() []string {
+		var buf bytes.Buffer
+		recursiveSearch(context.Background(), "needle", tmp, &buf)
+		var order []string
+		for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+			rel, _ := filepath.Rel(tmp, strings.TrimSuffix(line, ":needle"))
+			order = append(order, rel)
+		}
+		return order
+	}
+
+	// access times change once files are read, so check them first
+	if runtime.GOOS == "linux" {
+		sortBy = sortAccessed
+		if got, want := search(), []string{"b.txt", "a-c.txt", filepath.Join("a", "z.txt")}; !reflect.DeepEqual(got, want) {
+			t.Errorf("--sort accessed = %q, want %q", got, want)
+		}
+	}
+
+	sortBy = sortPath
+	want := []string{filepath.Join("a", "z.txt"), "a-c.txt", "b.txt"}
+	for range 5 {
+		if got := search(); !reflect.DeepEqual(got, want) {
+			t.Fatalf("--sort path = %q, want %q", got, want)
+		}
+	}
+
+	sortBy = ""
+	sortReverse = sortModified
+	if got, want := search(), []string{"b.txt", filepath.Join("a", "z.txt"), "a-c.txt"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("--sortr modified = %q, want %q", got, want)
+	}
+
+	sortReverse = ""
+	sortBy = sortPath
+	heading = true
+	var buf bytes.Buffer
+	recursiveSearch(context.Background(), "needle", tmp, &buf)
+	wantOutput := filepath.Join(tmp, "a", "z.txt") + "\nneedle\n\n" +
+		filepath.Join(tmp, "a-c.txt") + "\nneedle\n\n" +
+		filepath.Join(tmp, "b.txt") + "\nneedle\n"
+	if buf.String() != wantOutput {
+		t.Errorf("--heading output =\n%q\nwant\n%q", buf.String(), wantOutput)
+	}
+
+	nullSeparated = true
+	defer func() { nullSeparated = false }()
+	buf.Reset()
+	recursiveSearch(context.Background(), "needle", tmp, &buf)
+	wantOutput = filepath.Join(tmp, "a", "z.txt") + "\x00needle\n\n" +
+		filepath.Join(tmp, "a-c.txt") + "\x00needle\n\n" +
+		filepath.Join(tmp, "b.txt") + "\x00needle\n"
+	if buf.String() != wantOutput {
+		t.Errorf("--heading -Z output =\n%q\nwant\n%q", buf.String(), wantOutput)
+	}
+}
+
+func TestSortResultsUnknownTimesLast(t *testing.T) {
+	at := time.Date(2025, 5, 1, 0, 0, 0, 0, time.UTC)
+	results := []fileResult{
+		{path: "c"},
+		{path: "b", time: at, hasTime: true},
+		{path: "a"},
+		{path: "d", time: at.Add(time.Hour), hasTime: true},
+	}
+
+	for _, reverse := range []bool{false, true} {
+		sortResults(results, sortCreated, reverse)
+		var got []string
+		for _, result := range results {
+			got = append(got, result.path)
+		}
+		want := []string{"b", "d", "a", "c"}
+		if reverse {
+			want = []string{"d", "b", "c", "a"}
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("sortResults(reverse=%v) = %q, want %q", reverse, got, want)
+		}
+	}
+}
+
+// captureStderr returns what fn writes to os.Stderr.
+func captureStderr(t *testing.T, fn func()) string {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := os.Stderr
+	os.Stderr = w
+	defer func() { os.Stderr = saved }()
+
+	output := make(chan string)
+	go func() {
+		data, _ := io.ReadAll(r)
+		output <- string(data)
+	}()
+	fn()
+	w.Close()
+	return <-output
+}
+
+func TestListSearchFilesDebug(t *testing.T) {
+	defer func() {
+		typeFilter = nil
+		maxFileSize = -1
+		maxDepth = -1
+		debug = false
+		nullSeparated = false
+	}()
+
+	tmp := t.TempDir()
+	os.MkdirAll(filepath.Join(tmp, "sub", "deep"), 0755)
+	os.WriteFile(filepath.Join(tmp, "main.go"), []byte("package main\n"), 0644)
+	os.WriteFile(filepath.Join(tmp, "big.go"), []byte(strings.Repeat("x", 2048)), 0644)
+	os.WriteFile(filepath.Join(tmp, "notes.txt"), []byte("notes\n"), 0644)
+	os.WriteFile(filepath.Join(tmp, "sub", "util.go"), []byte("package sub\n"), 0644)
+	os.WriteFile(filepath.Join(tmp, "sub", "deep", "x.go"), []byte("package deep\n"), 0644)
+	os.Symlink(filepath.Join(tmp, "main.go"), filepath.Join(tmp, "link.go"))
+
+	registry, _ := newTypeRegistry(nil)
+	typeFilter, _ = newFileTypeFilter(registry, []string{"go"}, nil)
+	maxFileSize = 1024
+	maxDepth = 2
+	debug = true
+
+	var buf bytes.Buffer
+	stderr := captureStderr(t, func() {
+		if _, err := listSearchFiles(context.Background(), tmp, &buf); err != nil {
+			t.Errorf("listSearchFiles() error = %v", err)
+		}
+	})
+
+	want := filepath.Join(tmp, "main.go") + "\n" + filepath.Join(tmp, "sub", "util.go") + "\n"
+	if buf.String() != want {
+		t.Errorf("listSearchFiles() = %q, want %q", buf.String(), want)
+	}
+
+	for _, reason := range []string{
+		filepath.Join(tmp, "big.go") + ": 2048 bytes, larger than --max-filesize 1024",
+		filepath.Join(tmp, "notes.txt") + ": not a file type selected by -t",
+		filepath.Join(tmp, "link.go") + ": symbolic link, use -L to follow",
+		filepath.Join(tmp, "sub", "deep") + ": deeper than --max-depth 2",
+	} {
+		if !strings.Contains(stderr, "debug: skipping "+reason+"\n") {
+			t.Errorf("debug output missing %q:\n%s", reason, stderr)
+		}
+	}
+
+	debug = false
+	nullSeparated = true
+	buf.Reset()
+	stderr = captureStderr(t, func() { listSearchFiles(context.Background(), tmp, &buf) })
+	if stderr != "" {
+		t.Errorf("unexpected output without --debug: %q", stderr)
+	}
+	if want := strings.ReplaceAll(want, "\n", "\x00"); buf.String() != want {
+		t.Errorf("listSearchFiles() with -Z = %q, want %q", buf.String(), want)
+	}
+}
+
+func TestRecursiveSearchUnreadableFile(t *testing.T) {
+	countOnly = false
+	before, after = 0, 0
+	caseInsensitive = false
+
+	tmp := t.TempDir()
+	readable := filepath.Join(tmp, "a.txt")
+	os.WriteFile(readable, []byte("needle\n"), 0644)
+	// a socket can't be opened, even by root, for whom permissions don't apply
+	socket := filepath.Join(tmp, "s.sock")
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Skipf("cannot create a socket: %v", err)
+	}
+	defer listener.Close()
+
+	var buf bytes.Buffer
+	var ok bool
+	stderr := captureStderr(t, func() {
+		ok, err = recursiveSearch(context.Background(), "needle", tmp, &buf)
+	})
+	if err != nil || ok {
+		t.Errorf("recursiveSearch() = %v, %v, want false, nil", ok, err)
+	}
+	if want := readable + ":needle\n"; buf.String() != want {
+		t.Errorf("recursiveSearch() = %q, want %q", buf.String(), want)
+	}
+	if !strings.Contains(stderr, socket) {
+		t.Errorf("unreadable file not reported: %q", stderr)
+	}
+
+	// a root that can't be walked is reported the same way
+	missing := filepath.Join(tmp, "missing")
+	buf.Reset()
+	stderr = captureStderr(t, func() {
+		ok, err = recursiveSearch(context.Background(), "needle", missing, &buf)
+	})
+	if err != nil || ok || !strings.Contains(stderr, missing) {
+		t.Errorf("recursiveSearch() of a missing root = %v, %v with %q, want false, nil and a message", ok, err, stderr)
+	}
+
+	buf.Reset()
+	stderr = captureStderr(t, func() {
+		ok, err = listSearchFiles(context.Background(), tmp, &buf)
+	})
+	if err != nil || ok {
+		t.Errorf("listSearchFiles() = %v, %v, want false, nil", ok, err)
+	}
+	if want := readable + "\n"; buf.String() != want {
+		t.Errorf("listSearchFiles() = %q, want %q", buf.String(), want)
+	}
+	if !strings.Contains(stderr, socket) {
+		t.Errorf("unreadable file not reported: %q", stderr)
+	}
+}
+
+func TestGrepFileMmapMatchesScanner(t *testing.T) {
+	if !mmapSupported {
+		t.Skip("mmap is not used on this platform")
+	}
+	caseInsensitive = false
+	defer func() {
+		forceMmap, noMmap = false, false
+		countOnly, before, after, lineNumbers = false, 0, 0, false
+	}()
+
+	var content strings.Builder
+	for i := 0; i < 5000; i++ {
+		switch {
+		case i%97 == 0:
+			fmt.Fprintf(&content, "line %d has the needle\r\n", i)
+		case i%13 == 0:
+			content.WriteString("\n")
+		default:
+			fmt.Fprintf(&content, "line %d is plain\n", i)
+		}
+	}
+	content.WriteString("last needle without a newline")
+
+	path := filepath.Join(t.TempDir(), "input.log")
+	os.WriteFile(path, []byte(content.String()), 0644)
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	settings := []struct {
+		countOnly, lineNumbers bool
+		before, after          int
+	}{
+		{},
+		{lineNumbers: true, before: 2, after: 1},
+		{countOnly: true},
+	}
+	for _, setting := range settings {
+		countOnly, lineNumbers, before, after = setting.countOnly, setting.lineNumbers, setting.before, setting.after
+
+		forceMmap, noMmap = false, true
+		file.Seek(0, io.SeekStart)
+		want, err := grepFile(context.Background(), "needle", file)
+		if err != nil {
+			t.Fatalf("grepFile() without mmap error = %v", err)
+		}
+
+		forceMmap, noMmap = true, false
+		got, err := grepFile(context.Background(), "needle", file)
+		if err != nil {
+			t.Fatalf("grepFile() with mmap error = %v", err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%+v: mmap search differs from the scanner:\n got %q\nwant %q", setting, got, want)
+		}
+
+		data, err := mmapFile(file, int64(content.Len()))
+		if err != nil {
+			t.Fatalf("mmapFile() error = %v", err)
+		}
+		got, err = searchMapping(context.Background(), "needle", data, 7)
+		munmapFile(data)
+		if err != nil || !reflect.DeepEqual(got, want) {
+			t.Errorf("%+v: chunked mmap search = %q, %v; want %q", setting, got, err, want)
+		}
+	}
+}
+
+func TestGrepFileMmapLongLines(t *testing.T) {
+	if !mmapSupported {
+		t.Skip("mmap is not used on this platform")
+	}
+	countOnly, before, after, lineNumbers = false, 0, 0, false
+	caseInsensitive = false
+	defer func() { forceMmap, noMmap = false, false }()
+
+	tests := []struct {
+		content string
+		tooLong bool
+	}{
+		{content: "needle\n" + strings.Repeat("x", bufio.MaxScanTokenSize-1) + "\nneedle\n"},
+		{content: "needle\n" + strings.Repeat("x", bufio.MaxScanTokenSize) + "\nneedle\n", tooLong: true},
+		{content: "needle\n" + strings.Repeat("x", bufio.MaxScanTokenSize-1)},
+		{content: "needle\n" + strings.Repeat("x", 100<<10), tooLong: true},
+	}
+	for _, test := range tests {
+		path := filepath.Join(t.TempDir(), "long.txt")
+		os.WriteFile(path, []byte(test.content), 0644)
+		file, err := os.Open(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, mapped := range []bool{false, true} {
+			forceMmap, noMmap = mapped, !mapped
+			file.Seek(0, io.SeekStart)
+			got, err := grepFile(context.Background(), "needle", file)
+			if test.tooLong {
+				if !errors.Is(err, bufio.ErrTooLong) {
+					t.Errorf("mmap=%v, %d bytes: grepFile() error = %v, want %v", mapped, len(test.content), err, bufio.ErrTooLong)
+				}
+				continue
+			}
+			if err != nil || len(got) == 0 {
+				t.Errorf("mmap=%v, %d bytes: grepFile() = %q, %v", mapped, len(test.content), got, err)
+			}
+		}
+		file.Close()
+	}
+}
+
+func TestSearchMappingTruncatedFile(t *testing.T) {
+	if !mmapSupported {
+		t.Skip("mmap is not used on this platform")
+	}
+	countOnly, before, after = false, 0, 0
+
+	path := filepath.Join(t.TempDir(), "shrinking.log")
+	os.WriteFile(path, bytes.Repeat([]byte("no match here\n"), 1<<16), 0644)
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	info, _ := file.Stat()
+
+	data, err := mmapFile(file, info.Size())
+	if err != nil {
+		t.Fatalf("mmapFile() error = %v", err)
+	}
+	defer munmapFile(data)
+
+	// the pages past the new end of file now raise SIGBUS when read
+	if err := os.Truncate(path, 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := searchMapping(context.Background(), "needle", data, 4); !errors.Is(err, errMapFailed) {
+		t.Errorf("searchMapping() error = %v, want errMapFailed", err)
+	}
+
+	// grepFile falls back to reading what is left of the file
+	forceMmap = true
+	defer func() { forceMmap = false }()
+	os.WriteFile(path, []byte("a needle\n"), 0644)
+	matches, err := grepFile(context.Background(), "needle", file)
+	if err != nil || !reflect.DeepEqual(matches, []string{"a needle"}) {
+		t.Errorf("grepFile() = %q, %v", matches, err)
+	}
+}
+
+func TestUseMmap(t *testing.T) {
+	defer func() { forceMmap, noMmap = false, false }()
+
+	dir := t.TempDir()
+	small := filepath.Join(dir, "small")
+	os.WriteFile(small, []byte("x\n"), 0644)
+	empty := filepath.Join(dir, "empty")
+	os.WriteFile(empty, nil, 0644)
+	smallInfo, _ := os.Stat(small)
+	emptyInfo, _ := os.Stat(empty)
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	defer w.Close()
+	pipeInfo, _ := r.Stat()
+
+	if useMmap(smallInfo) {
+		t.Errorf("small files should be read by default")
+	}
+	forceMmap = true
+	if useMmap(smallInfo) != mmapSupported {
+		t.Errorf("--mmap should map small files where mmap is supported")
+	}
+	if useMmap(emptyInfo) || useMmap(pipeInfo) {
+		t.Errorf("empty files and pipes must never be mapped")
+	}
+	forceMmap, noMmap = false, true
+	if useMmap(smallInfo) {
+		t.Errorf("--no-mmap should disable mapping")
+	}
+}
+
+func BenchmarkGrepMmap(b *testing.B) {
+	if !mmapSupported {
+		b.Skip("mmap is not used on this platform")
+	}
+	countOnly, before, after, caseInsensitive = true, 0, 0, false
+	defer func() { countOnly = false }()
+	file, size := writeBenchmarkLog(b)
+
+	b.SetBytes(size)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		grepMapped(context.Background(), "connection reset", file, size, 1)
+	}
+}
+
+func BenchmarkGrepMmapChunked(b *testing.B) {
+	if !mmapSupported {
+		b.Skip("mmap is not used on this platform")
+	}
+	countOnly, before, after, caseInsensitive = true, 0, 0, false
+	defer func() { countOnly = false }()
+	file, size := writeBenchmarkLog(b)
+
+	b.SetBytes(size)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		grepMapped(context.Background(), "connection reset", file, size, runtime.GOMAXPROCS(0))
+	}
+}
@@ -0,0 +1,444 @@
+package cmd
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+var serveRoot, serveAddr string
+var serveTimeout time.Duration
+var serveMaxSearches int
+
+// serveKillGrace is how long a search may run past its timeout, while it
+// writes out its partial results, before it is killed.
+const serveKillGrace = 5 * time.Second
+
+// serveFlags are the search flags a /search request may set, by long name.
+// Flags that read or write arbitrary files or leave the root are excluded.
+var serveFlags = map[string]bool{
+	"i":               true,
+	"after":           true,
+	"before":          true,
+	"count":           true,
+	"type":            true,
+	"type-not":        true,
+	"type-add":        true,
+	"one-file-system": true,
+	"newer-than":      true,
+	"max-filesize":    true,
+	"min-filesize":    true,
+	"max-depth":       true,
+	"jsonl-field":     true,
+	"fields":          true,
+	"jsonl-invalid":   true,
+	"query":           true,
+	"fuzzy":           true,
+}
+
+var serveCmd = &cobra.Command{
+	Use:   "serve --root DIR",
+	Short: "Serve searches of a directory over HTTP",
+	Long: `Serve recursive searches of DIR over HTTP.
+
+GET /search?q=SEARCH_STRING runs "mygrep -r SEARCH_STRING" under DIR and
+streams the results as newline-delimited JSON, or as Server-Sent Events
+with format=sse or "Accept: text/event-stream". Other parameters:
+
+	path=P       search P, relative to DIR, instead of all of DIR
+	timeout=D    stop the search after D (capped at --timeout)
+	i, after, before, count, type, type-not, type-add, one-file-system,
+	newer-than, max-filesize, min-filesize, max-depth, jsonl-field, fields,
+	jsonl-invalid, query, fuzzy
+	             the search flags of the same name (or shorthand, e.g. A=2)
+
+Each result is an object with a "type" of "match", "context" or "count";
+the stream ends with an "end" object whose "status" is "ok", "timeout" or
+"error". A search that finished but could not read some files or
+directories ends "ok" with the messages about them in "warnings".`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		server, err := newSearchServer(serveRoot, serveMaxSearches, serveTimeout)
+		if err != nil {
+			return err
+		}
+		return listenAndServe(cmd.Context(), serveAddr, server)
+	},
+}
+
+func init() {
+	serveCmd.Flags().StringVar(&serveRoot, "root", "", "Directory to serve searches of")
+	serveCmd.Flags().StringVar(&serveAddr, "addr", ":8080", "Address to listen on")
+	serveCmd.Flags().DurationVar(&serveTimeout, "timeout", 30*time.Second, "Longest a single search may run")
+	serveCmd.Flags().IntVar(&serveMaxSearches, "max-searches", runtime.NumCPU(), "Searches to run at once; further requests get 503")
+	serveCmd.MarkFlagRequired("root")
+	rootCmd.AddCommand(serveCmd)
+}
+
+// listenAndServe serves handler on addr until ctx is cancelled, then lets
+// running searches finish.
+func listenAndServe(ctx context.Context, addr string, handler http.Handler) error {
+	server := &http.Server{
+		Addr:              addr,
+		Handler:           handler,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	errs := make(chan error, 1)
+	go func() { errs <- server.ListenAndServe() }()
+	fmt.Fprintf(os.Stderr, "%s: serving %s on %s\n", os.Args[0], serveRoot, addr)
+
+	select {
+	case err := <-errs:
+		return err
+	case <-ctx.Done():
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), serveKillGrace)
+	defer cancel()
+	return server.Shutdown(shutdownCtx)
+}
+
+// searchServer answers /search requests. Search settings are process-wide,
+// so each search runs in its own mygrep process with the request's flags.
+type searchServer struct {
+	root       string // absolute, with symlinks resolved
+	executable string
+	env        []string
+	timeout    time.Duration
+	slots      chan struct{}
+	mux        *http.ServeMux
+}
+
+func newSearchServer(root string, maxSearches int, timeout time.Duration) (*searchServer, error) {
+	root, err := filepath.Abs(root)
+	if err == nil {
+		root, err = filepath.EvalSymlinks(root)
+	}
+	if err != nil {
+		return nil, err
+	}
+	info, err := os.Stat(root)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("%s: not a directory", root)
+	}
+
+	executable, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+
+	s := &searchServer{
+		root:       root,
+		executable: executable,
+		env:        os.Environ(),
+		timeout:    timeout,
+		slots:      make(chan struct{}, max(1, maxSearches)),
+		mux:        http.NewServeMux(),
+	}
+	s.mux.HandleFunc("/search", s.handleSearch)
+	return s, nil
+}
+
+func (s *searchServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mux.ServeHTTP(w, r)
+}
+
+// searchEvent is one object in the response stream.
+type searchEvent struct {
+	Type     string   `json:"type"`
+	Path     string   `json:"path,omitempty"`
+	Line     int64    `json:"line,omitempty"`
+	Text     *string  `json:"text,omitempty"`
+	Count    *int     `json:"count,omitempty"`
+	Status   string   `json:"status,omitempty"`
+	Error    string   `json:"error,omitempty"`
+	Warnings []string `json:"warnings,omitempty"`
+}
+
+func (s *searchServer) handleSearch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		writeHTTPError(w, http.StatusMethodNotAllowed, "only GET is supported")
+		return
+	}
+
+	params := r.URL.Query()
+	args, countOnly, err := s.searchArgs(params)
+	if err != nil {
+		writeHTTPError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	timeout := s.timeout
+	if value := params.Get("timeout"); value != "" {
+		requested, err := time.ParseDuration(value)
+		if err != nil || requested <= 0 {
+			writeHTTPError(w, http.StatusBadRequest, fmt.Sprintf("invalid timeout %q", value))
+			return
+		}
+		timeout = min(timeout, requested)
+	}
+	args = append([]string{"--timeout=" + timeout.String()}, args...)
+
+	sse := params.Get("format") == "sse" || strings.Contains(r.Header.Get("Accept"), "text/event-stream")
+	if format := params.Get("format"); format != "" && format != "sse" && format != "ndjson" {
+		writeHTTPError(w, http.StatusBadRequest, fmt.Sprintf("invalid format %q: want ndjson or sse", format))
+		return
+	}
+
+	select {
+	case s.slots <- struct{}{}:
+		defer func() { <-s.slots }()
+	default:
+		w.Header().Set("Retry-After", "1")
+		writeHTTPError(w, http.StatusServiceUnavailable, "too many searches in progress")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), timeout+serveKillGrace)
+	defer cancel()
+	s.stream(ctx, w, args, sse, countOnly)
+}
+
+// searchArgs turns request parameters into mygrep arguments, rejecting
+// flags outside serveFlags and paths outside the root. It also reports
+// whether the search counts matches, from the same parsed value of the
+// count flag that is passed to mygrep.
+func (s *searchServer) searchArgs(params url.Values) ([]string, bool, error) {
+	args := []string{"--no-config", "-r", "-n", "-Z"}
+
+	// a boolean may be given more than once, as count and c, so each is
+	// parsed into bools and passed on once
+	bools := make(map[string]bool)
+
+	for name, values := range params {
+		switch name {
+		case "q", "path", "timeout", "format":
+			continue
+		}
+
+		flag := rootCmd.Flags().Lookup(name)
+		if flag == nil && len(name) == 1 {
+			flag = rootCmd.Flags().ShorthandLookup(name)
+		}
+		if flag == nil || !serveFlags[flag.Name] {
+			return nil, false, fmt.Errorf("unsupported parameter %q", name)
+		}
+
+		for _, value := range values {
+			if flag.Value.Type() != "bool" {
+				args = append(args, "--"+flag.Name+"="+value)
+				continue
+			}
+			if value == "" {
+				value = "true"
+			}
+			parsed, err := strconv.ParseBool(value)
+			if err != nil {
+				return nil, false, fmt.Errorf("invalid %s %q: want true or false", name, value)
+			}
+			if previous, ok := bools[flag.Name]; ok && previous != parsed {
+				return nil, false, fmt.Errorf("conflicting values for %s", flag.Name)
+			}
+			bools[flag.Name] = parsed
+		}
+	}
+	for name, value := range bools {
+		args = append(args, "--"+name+"="+strconv.FormatBool(value))
+	}
+
+	path, err := s.resolvePath(params.Get("path"))
+	if err != nil {
+		return nil, false, err
+	}
+
+	args = append(args, "--")
+	if !params.Has("query") && !params.Has("jsonl-field") {
+		searchString := params.Get("q")
+		if searchString == "" {
+			return nil, false, errors.New("missing q")
+		}
+		args = append(args, searchString)
+	}
+	return append(args, path), bools["count"], nil
+}
+
+// resolvePath checks that rel names an existing path inside the root, after
+// following symlinks, and returns it relative to the root.
+func (s *searchServer) resolvePath(rel string) (string, error) {
+	if rel == "" {
+		rel = "."
+	}
+	if !filepath.IsLocal(rel) {
+		return "", fmt.Errorf("path %q is not inside the served directory", rel)
+	}
+
+	resolved, err := filepath.EvalSymlinks(filepath.Join(s.root, rel))
+	if err != nil {
+		return "", fmt.Errorf("path %q not found", rel)
+	}
+	inside, err := filepath.Rel(s.root, resolved)
+	if err != nil || !filepath.IsLocal(inside) {
+		return "", fmt.Errorf("path %q is not inside the served directory", rel)
+	}
+	return inside, nil
+}
+
+// stream runs mygrep with args and writes its results as they arrive. The
+// response stays uncommitted until the first result, so a search rejected
+// by mygrep's own flag checks is still reported as a 400.
+func (s *searchServer) stream(ctx context.Context, w http.ResponseWriter, args []string, sse, countOnly bool) {
+	cmd := exec.CommandContext(ctx, s.executable, args...)
+	// keep the server's install path out of error messages
+	cmd.Args[0] = "mygrep"
+	cmd.Dir = s.root
+	cmd.Env = s.env
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+
+	stdout, err := cmd.StdoutPipe()
+	if err == nil {
+		err = cmd.Start()
+	}
+	if err != nil {
+		writeHTTPError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	events := &eventWriter{w: w, sse: sse}
+	reader := bufio.NewReader(stdout)
+	for {
+		line, err := reader.ReadString('\n')
+		if line = strings.TrimSuffix(line, "\n"); line != "" {
+			if event, ok := parseSearchLine(line, countOnly); ok {
+				events.write(event)
+			}
+		}
+		if err != nil {
+			break
+		}
+	}
+
+	waitErr := cmd.Wait()
+	var exitErr *exec.ExitError
+	status := 0
+	if errors.As(waitErr, &exitErr) {
+		status = exitErr.ExitCode()
+	}
+
+	end := searchEvent{Type: "end", Status: "ok"}
+	switch {
+	case waitErr == nil:
+	case status == exitUnreadable:
+		end.Warnings = strings.Split(strings.TrimSpace(stderr.String()), "\n")
+	case status == 1 && !events.started:
+		writeHTTPError(w, http.StatusBadRequest, firstLine(stderr.String()))
+		return
+	case status == 2 || ctx.Err() != nil:
+		end.Status = "timeout"
+	default:
+		end.Status = "error"
+		end.Error = firstLine(stderr.String())
+		if end.Error == "" {
+			end.Error = waitErr.Error()
+		}
+	}
+	events.write(end)
+}
+
+// parseSearchLine parses a line of "mygrep -r -n -Z" output: the path, a NUL
+// byte, and either a count or a line number, ':' or '-', and the text.
+func parseSearchLine(line string, countOnly bool) (searchEvent, bool) {
+	path, rest, ok := strings.Cut(line, "\x00")
+	if !ok {
+		return searchEvent{}, false
+	}
+
+	if countOnly {
+		count, err := strconv.Atoi(rest)
+		if err != nil {
+			return searchEvent{}, false
+		}
+		return searchEvent{Type: "count", Path: path, Count: &count}, true
+	}
+
+	end := strings.IndexFunc(rest, func(r rune) bool { return r < '0' || r > '9' })
+	if end <= 0 {
+		return searchEvent{}, false
+	}
+	number, err := strconv.ParseInt(rest[:end], 10, 64)
+	if err != nil {
+		return searchEvent{}, false
+	}
+
+	event := searchEvent{Type: "match", Path: path, Line: number}
+	if rest[end] == '-' {
+		event.Type = "context"
+	}
+	text := rest[end+1:]
+	event.Text = &text
+	return event, true
+}
+
+// eventWriter writes searchEvents as NDJSON or SSE, flushing each one.
+type eventWriter struct {
+	w       http.ResponseWriter
+	sse     bool
+	started bool
+}
+
+func (e *eventWriter) write(event searchEvent) {
+	if !e.started {
+		contentType := "application/x-ndjson"
+		if e.sse {
+			contentType = "text/event-stream"
+		}
+		e.w.Header().Set("Content-Type", contentType)
+		e.w.Header().Set("Cache-Control", "no-cache")
+		e.w.Header().Set("X-Content-Type-Options", "nosniff")
+		e.w.WriteHeader(http.StatusOK)
+		e.started = true
+	}
+
+	data, _ := json.Marshal(event)
+	if e.sse {
+		fmt.Fprintf(e.w, "event: %s\ndata: %s\n\n", event.Type, data)
+	} else {
+		fmt.Fprintf(e.w, "%s\n", data)
+	}
+	if flusher, ok := e.w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func writeHTTPError(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": message})
+}
+
+// firstLine returns the first line of a mygrep error message without
+// cobra's "Error: " label.
+func firstLine(s string) string {
+	line, _, _ := strings.Cut(strings.TrimSpace(s), "\n")
+	return strings.TrimPrefix(line, "Error: ")
+}
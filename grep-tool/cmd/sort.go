@@ -0,0 +1,109 @@
+package cmd
+
+import (
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+var sortBy, sortReverse string
+
+const (
+	sortNone     = "none"
+	sortPath     = "path"
+	sortModified = "modified"
+	sortAccessed = "accessed"
+	sortCreated  = "created"
+)
+
+// sortOrder returns the key from --sort or --sortr and whether it is reversed.
+func sortOrder() (key string, reverse bool) {
+	if sortReverse != "" {
+		return sortReverse, true
+	}
+	if sortBy != "" {
+		return sortBy, false
+	}
+	return sortNone, false
+}
+
+func validSortKey(key string) bool {
+	switch key {
+	case sortNone, sortPath, sortModified, sortAccessed, sortCreated:
+		return true
+	}
+	return false
+}
+
+// fileResult is one file's matches, held back until every file has been
+// searched so they can be printed in order.
+type fileResult struct {
+	path    string
+	matches []string
+	time    time.Time
+	hasTime bool
+}
+
+// newFileResult records the time key sorts by. info must come from before
+// the file was read, or its access time would be that of the search.
+func newFileResult(path string, matches []string, info fs.FileInfo, key string) fileResult {
+	result := fileResult{path: path, matches: matches}
+	if info == nil {
+		return result
+	}
+
+	switch key {
+	case sortModified:
+		result.time, result.hasTime = info.ModTime(), true
+	case sortAccessed:
+		result.time, result.hasTime = accessTime(info)
+	case sortCreated:
+		result.time, result.hasTime = birthTime(path)
+	}
+	return result
+}
+
+// sortResults orders results by key, oldest first for times. Files without
+// the time, and files with equal times, fall back to path order, so the
+// output doesn't depend on which worker finished first.
+func sortResults(results []fileResult, key string, reverse bool) {
+	sort.SliceStable(results, func(i, j int) bool {
+		a, b := results[i], results[j]
+		if reverse {
+			a, b = b, a
+		}
+		if key != sortPath && a.hasTime != b.hasTime {
+			// unknown times go last either way
+			return results[i].hasTime
+		}
+		if key != sortPath && a.hasTime && !a.time.Equal(b.time) {
+			return a.time.Before(b.time)
+		}
+		return comparePaths(a.path, b.path) < 0
+	})
+}
+
+// comparePaths compares paths one element at a time, matching the order in
+// which a directory walk visits them.
+func comparePaths(a, b string) int {
+	as := strings.Split(filepath.ToSlash(a), "/")
+	bs := strings.Split(filepath.ToSlash(b), "/")
+	for i := 0; i < len(as) && i < len(bs); i++ {
+		if c := strings.Compare(as[i], bs[i]); c != 0 {
+			return c
+		}
+	}
+	return len(as) - len(bs)
+}
+
+func checkSortFlags() error {
+	for _, key := range []string{sortBy, sortReverse} {
+		if key != "" && !validSortKey(key) {
+			return fmt.Errorf("invalid sort key %q: want path, modified, accessed, created or none", key)
+		}
+	}
+	return nil
+}
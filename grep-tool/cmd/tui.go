@@ -0,0 +1,652 @@
+package cmd
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/spf13/cobra"
+	"golang.org/x/term"
+)
+
+// maxTUIHits bounds how many matches the browser keeps in memory.
+const maxTUIHits = 10000
+
+const (
+	clearScreen     = "\x1b[H\x1b[2J"
+	enterAltScreen  = "\x1b[?1049h\x1b[?25l"
+	leaveAltScreen  = "\x1b[?25h\x1b[?1049l"
+	inputPattern    = 0
+	inputTypes      = 1
+	tuiHelp         = "Up/Down select  Enter open  Tab next field  ^T ignore case  ^U clear  ^C quit"
+	tuiTickInterval = 200 * time.Millisecond
+)
+
+var tuiCmd = &cobra.Command{
+	Use:   "tui [PATH]",
+	Short: "Browse search results interactively",
+	Long: `Search PATH (default ".") interactively. Matches stream into the list on
+the left while the file around the selected match is shown on the right.
+
+Typing edits the search string; Tab switches to the file types field, which
+takes comma-separated type names (prefix a name with ! to exclude it).
+Up/Down or Ctrl-P/Ctrl-N move the selection, PgUp/PgDn move a page, Ctrl-T
+toggles case-insensitive search, Ctrl-U clears the field and Enter opens the
+selected match in $VISUAL or $EDITOR at its line. Ctrl-C or Esc quits.`,
+	Args: cobra.MaximumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		root := "."
+		if len(args) == 1 {
+			root = args[0]
+		}
+		return runTerminalTUI(cmd.Context(), root)
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(tuiCmd)
+}
+
+// searchHit is one matching line shown in the browser.
+type searchHit struct {
+	path string
+	line int64
+	text string
+}
+
+// hitBatch carries the matches of one file from the search goroutine.
+// Batches from a superseded search are recognised by their generation.
+type hitBatch struct {
+	generation int
+	hits       []searchHit
+	done       bool
+}
+
+type keyCode int
+
+const (
+	keyRune keyCode = iota
+	keyEnter
+	keyTab
+	keyBackspace
+	keyUp
+	keyDown
+	keyPageUp
+	keyPageDown
+	keyToggleCase
+	keyClear
+	keyQuit
+)
+
+type key struct {
+	code keyCode
+	r    rune
+}
+
+// tui is the state of the interactive browser. It is driven by run, which
+// reads keys from any io.Reader and writes whole frames to any io.Writer,
+// so tests can play the part of the terminal.
+type tui struct {
+	root       string
+	size       func() (width, height int)
+	openEditor func(path string, line int64) error
+
+	inputs     [2][]rune
+	focus      int
+	ignoreCase bool
+
+	hits      []searchHit
+	files     int
+	selected  int
+	offset    int
+	searching bool
+	message   string
+
+	generation int
+	cancel     context.CancelFunc
+	done       chan struct{}
+	batches    chan hitBatch
+
+	previewKey   string
+	previewLines []string
+}
+
+func newTUI(root string) *tui {
+	return &tui{
+		root:       root,
+		size:       func() (int, int) { return 80, 24 },
+		openEditor: func(string, int64) error { return errors.New("no editor configured") },
+		batches:    make(chan hitBatch, 64),
+	}
+}
+
+// runTerminalTUI runs the browser on the controlling terminal in raw mode,
+// restoring the terminal around editor sessions and on exit.
+func runTerminalTUI(ctx context.Context, root string) error {
+	inFd, outFd := int(os.Stdin.Fd()), int(os.Stdout.Fd())
+	if !term.IsTerminal(inFd) || !term.IsTerminal(outFd) {
+		return errors.New("tui needs an interactive terminal")
+	}
+
+	state, err := term.MakeRaw(inFd)
+	if err != nil {
+		return err
+	}
+	fmt.Fprint(os.Stdout, enterAltScreen)
+	defer func() {
+		fmt.Fprint(os.Stdout, leaveAltScreen)
+		term.Restore(inFd, state)
+	}()
+
+	ui := newTUI(root)
+	ui.size = func() (int, int) {
+		width, height, err := term.GetSize(outFd)
+		if err != nil {
+			return 80, 24
+		}
+		return width, height
+	}
+	ui.openEditor = func(path string, line int64) error {
+		fmt.Fprint(os.Stdout, leaveAltScreen)
+		term.Restore(inFd, state)
+
+		editorErr := runEditor(path, line)
+
+		state, err = term.MakeRaw(inFd)
+		fmt.Fprint(os.Stdout, enterAltScreen)
+		if editorErr != nil {
+			return editorErr
+		}
+		return err
+	}
+
+	return ui.run(ctx, os.Stdin, os.Stdout)
+}
+
+// runEditor opens path at line in $VISUAL, $EDITOR or vi, using the "+LINE"
+// argument that vi, vim, nano and emacs understand.
+func runEditor(path string, line int64) error {
+	editor := os.Getenv("VISUAL")
+	if editor == "" {
+		editor = os.Getenv("EDITOR")
+	}
+	if editor == "" {
+		editor = "vi"
+	}
+
+	fields := strings.Fields(editor)
+	args := append(fields[1:], "+"+strconv.FormatInt(line, 10), path)
+	cmd := exec.Command(fields[0], args...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	return cmd.Run()
+}
+
+func (t *tui) run(ctx context.Context, in io.Reader, out io.Writer) error {
+	keys := make(chan []key)
+	ready := make(chan struct{}, 1)
+	go readKeys(in, ready, keys)
+	ready <- struct{}{}
+
+	ticker := time.NewTicker(tuiTickInterval)
+	defer ticker.Stop()
+	defer t.stopSearch()
+
+	width, height := t.size()
+	t.draw(out, width, height)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+
+		case batch := <-t.batches:
+			if batch.generation != t.generation {
+				continue
+			}
+			t.applyBatch(batch)
+
+		case chunk, ok := <-keys:
+			if !ok {
+				return nil
+			}
+			for _, k := range chunk {
+				if t.handleKey(ctx, k) {
+					return nil
+				}
+			}
+			ready <- struct{}{}
+
+		case <-ticker.C:
+			w, h := t.size()
+			if w == width && h == height {
+				continue
+			}
+		}
+
+		width, height = t.size()
+		t.draw(out, width, height)
+	}
+}
+
+// readKeys reads one chunk of input each time ready is signalled, so that
+// nothing is read from the terminal while an editor owns it.
+func readKeys(in io.Reader, ready <-chan struct{}, keys chan<- []key) {
+	defer close(keys)
+
+	buf := make([]byte, 256)
+	for range ready {
+		for {
+			n, err := in.Read(buf)
+			if n > 0 {
+				keys <- parseKeys(buf[:n])
+				break
+			}
+			if err != nil {
+				return
+			}
+		}
+	}
+}
+
+func parseKeys(data []byte) []key {
+	var keys []key
+	for len(data) > 0 {
+		if data[0] == 0x1b {
+			if len(data) >= 3 && (data[1] == '[' || data[1] == 'O') {
+				switch data[2] {
+				case 'A':
+					keys = append(keys, key{code: keyUp})
+				case 'B':
+					keys = append(keys, key{code: keyDown})
+				case '5', '6':
+					if len(data) >= 4 && data[3] == '~' {
+						code := keyPageUp
+						if data[2] == '6' {
+							code = keyPageDown
+						}
+						keys = append(keys, key{code: code})
+						data = data[4:]
+						continue
+					}
+				}
+				data = data[3:]
+				continue
+			}
+			keys = append(keys, key{code: keyQuit})
+			data = data[1:]
+			continue
+		}
+
+		r, size := utf8.DecodeRune(data)
+		data = data[size:]
+		switch r {
+		case 0x03, 0x11:
+			keys = append(keys, key{code: keyQuit})
+		case '\r', '\n':
+			keys = append(keys, key{code: keyEnter})
+		case '\t':
+			keys = append(keys, key{code: keyTab})
+		case 0x7f, 0x08:
+			keys = append(keys, key{code: keyBackspace})
+		case 0x0e:
+			keys = append(keys, key{code: keyDown})
+		case 0x10:
+			keys = append(keys, key{code: keyUp})
+		case 0x14:
+			keys = append(keys, key{code: keyToggleCase})
+		case 0x15:
+			keys = append(keys, key{code: keyClear})
+		default:
+			if r >= 0x20 && r != utf8.RuneError {
+				keys = append(keys, key{code: keyRune, r: r})
+			}
+		}
+	}
+	return keys
+}
+
+// handleKey applies k and reports whether the browser should quit.
+func (t *tui) handleKey(ctx context.Context, k key) bool {
+	switch k.code {
+	case keyQuit:
+		return true
+
+	case keyRune:
+		t.inputs[t.focus] = append(t.inputs[t.focus], k.r)
+		t.restartSearch(ctx)
+
+	case keyBackspace:
+		if n := len(t.inputs[t.focus]); n > 0 {
+			t.inputs[t.focus] = t.inputs[t.focus][:n-1]
+			t.restartSearch(ctx)
+		}
+
+	case keyClear:
+		t.inputs[t.focus] = nil
+		t.restartSearch(ctx)
+
+	case keyTab:
+		t.focus = (t.focus + 1) % len(t.inputs)
+
+	case keyToggleCase:
+		t.ignoreCase = !t.ignoreCase
+		t.restartSearch(ctx)
+
+	case keyUp:
+		t.moveSelection(-1)
+	case keyDown:
+		t.moveSelection(1)
+	case keyPageUp:
+		t.moveSelection(-t.bodyHeight())
+	case keyPageDown:
+		t.moveSelection(t.bodyHeight())
+
+	case keyEnter:
+		if t.selected < len(t.hits) {
+			hit := t.hits[t.selected]
+			err := t.openEditor(hit.path, hit.line)
+			if err != nil {
+				t.message = "editor: " + err.Error()
+			}
+		}
+	}
+	return false
+}
+
+func (t *tui) moveSelection(delta int) {
+	t.selected = max(0, min(t.selected+delta, len(t.hits)-1))
+}
+
+func (t *tui) bodyHeight() int {
+	_, height := t.size()
+	return max(1, height-4)
+}
+
+// restartSearch cancels any running search and starts one for the current
+// inputs. The search reads the package-level filter settings, which are
+// only changed here while no search is running.
+func (t *tui) restartSearch(ctx context.Context) {
+	t.stopSearch()
+	t.generation++
+	t.hits = nil
+	t.files = 0
+	t.selected = 0
+	t.offset = 0
+	t.message = ""
+	t.searching = false
+
+	pattern := string(t.inputs[inputPattern])
+	if pattern == "" {
+		return
+	}
+
+	filter, err := parseTypeInput(string(t.inputs[inputTypes]))
+	if err != nil {
+		t.message = err.Error()
+		return
+	}
+	typeFilter = filter
+	caseInsensitive = t.ignoreCase
+	// fileHits reads each match's line number from grepFile's -n output
+	lineNumbers = true
+	countOnly, before, after = false, 0, 0
+
+	searchCtx, cancel := context.WithCancel(ctx)
+	t.cancel = cancel
+	t.done = make(chan struct{})
+	t.searching = true
+	go t.search(searchCtx, t.generation, pattern, t.done)
+}
+
+func (t *tui) stopSearch() {
+	if t.cancel == nil {
+		return
+	}
+	t.cancel()
+	<-t.done
+	t.cancel = nil
+}
+
+// parseTypeInput turns the types field, e.g. "go,md,!json", into a filter.
+func parseTypeInput(input string) (*fileTypeFilter, error) {
+	var include, exclude []string
+	for _, name := range strings.Split(input, ",") {
+		name = strings.TrimSpace(name)
+		if strings.HasPrefix(name, "!") {
+			exclude = append(exclude, strings.TrimPrefix(name, "!"))
+		} else if name != "" {
+			include = append(include, name)
+		}
+	}
+
+	registry, err := newTypeRegistry(typeAdditions)
+	if err != nil {
+		return nil, err
+	}
+	return newFileTypeFilter(registry, include, exclude)
+}
+
+func (t *tui) search(ctx context.Context, generation int, pattern string, done chan struct{}) {
+	defer close(done)
+
+	send := func(batch hitBatch) {
+		batch.generation = generation
+		select {
+		case t.batches <- batch:
+		case <-ctx.Done():
+		}
+	}
+
+	// the browser has nowhere to show what it can't read, so it is skipped
+	walkSearchFiles(ctx, t.root, func(path string, err error) {
+		if err != nil {
+			return
+		}
+		hits := fileHits(ctx, path, pattern)
+		if len(hits) > 0 {
+			send(hitBatch{hits: hits})
+		}
+	})
+	send(hitBatch{done: true})
+}
+
+// fileHits returns the matching lines of one file, searched by grepFile as
+// the command-line search does, through --pre or a memory mapping where they
+// apply.
+func fileHits(ctx context.Context, path, pattern string) []searchHit {
+	file, err := validateFile(path)
+	if err != nil {
+		return nil
+	}
+	defer file.Close()
+
+	lines, _ := grepFile(ctx, pattern, file)
+	var hits []searchHit
+	for _, line := range lines {
+		number, text, _ := strings.Cut(line, ":")
+		n, err := strconv.ParseInt(number, 10, 64)
+		if err != nil {
+			continue
+		}
+		hits = append(hits, searchHit{path: path, line: n, text: text})
+	}
+	return hits
+}
+
+func (t *tui) applyBatch(batch hitBatch) {
+	if batch.done {
+		t.searching = false
+		return
+	}
+
+	// batches already queued when the limit was reached are dropped
+	if len(t.hits) >= maxTUIHits {
+		return
+	}
+
+	t.files++
+	room := maxTUIHits - len(t.hits)
+	if len(batch.hits) >= room {
+		t.hits = append(t.hits, batch.hits[:room]...)
+		t.message = fmt.Sprintf("stopped after %d matches", maxTUIHits)
+		t.stopSearch()
+		t.searching = false
+		return
+	}
+	t.hits = append(t.hits, batch.hits...)
+}
+
+func (t *tui) draw(out io.Writer, width, height int) {
+	fmt.Fprint(out, clearScreen+strings.Join(t.render(width, height), "\r\n"))
+}
+
+// render lays out a frame as height lines of at most width characters.
+func (t *tui) render(width, height int) []string {
+	if width < 20 || height < 5 {
+		return []string{fit("terminal too small", width)}
+	}
+
+	lines := make([]string, 0, height)
+	lines = append(lines, fit(t.header(), width))
+	lines = append(lines, fit(t.status(), width))
+	lines = append(lines, strings.Repeat("-", width))
+
+	body := height - 4
+	if t.selected < t.offset {
+		t.offset = t.selected
+	}
+	if t.selected >= t.offset+body {
+		t.offset = t.selected - body + 1
+	}
+
+	leftWidth := (width - 3) / 2
+	rightWidth := width - 3 - leftWidth
+	preview := t.preview(body)
+	for row := 0; row < body; row++ {
+		left := ""
+		if index := t.offset + row; index < len(t.hits) {
+			hit := t.hits[index]
+			marker := "  "
+			if index == t.selected {
+				marker = "> "
+			}
+			left = fmt.Sprintf("%s%s:%d: %s", marker, hit.path, hit.line, hit.text)
+		}
+		right := ""
+		if row < len(preview) {
+			right = preview[row]
+		}
+		lines = append(lines, pad(fit(left, leftWidth), leftWidth)+" | "+fit(right, rightWidth))
+	}
+
+	lines = append(lines, fit(tuiHelp, width))
+	return lines
+}
+
+func (t *tui) header() string {
+	fields := [2]string{"Search: ", "Types: "}
+	var b strings.Builder
+	for i, label := range fields {
+		if i == t.focus {
+			b.WriteString("[" + label + string(t.inputs[i]) + "_]")
+		} else {
+			b.WriteString(" " + label + string(t.inputs[i]) + " ")
+		}
+		b.WriteString("  ")
+	}
+	if t.ignoreCase {
+		b.WriteString("ignore case: on")
+	} else {
+		b.WriteString("ignore case: off")
+	}
+	return b.String()
+}
+
+func (t *tui) status() string {
+	if t.message != "" {
+		return t.message
+	}
+	if len(t.inputs[inputPattern]) == 0 {
+		return "type to search " + t.root
+	}
+	status := fmt.Sprintf("%d matches in %d files", len(t.hits), t.files)
+	if t.searching {
+		status += " (searching...)"
+	}
+	return status
+}
+
+// preview returns up to height numbered lines of the selected file centred
+// on the selected match, which is marked with '>'.
+func (t *tui) preview(height int) []string {
+	if t.selected >= len(t.hits) {
+		return nil
+	}
+	hit := t.hits[t.selected]
+
+	key := fmt.Sprintf("%s\x00%d\x00%d", hit.path, hit.line, height)
+	if key == t.previewKey {
+		return t.previewLines
+	}
+
+	first := max(1, hit.line-int64(height/2))
+	var lines []string
+
+	file, err := os.Open(hit.path)
+	if err != nil {
+		lines = []string{err.Error()}
+	} else {
+		scanner := bufio.NewScanner(file)
+		for number := int64(1); scanner.Scan() && len(lines) < height; number++ {
+			if number < first {
+				continue
+			}
+			marker := " "
+			if number == hit.line {
+				marker = ">"
+			}
+			lines = append(lines, fmt.Sprintf("%s%5d  %s", marker, number, scanner.Text()))
+		}
+		file.Close()
+	}
+
+	t.previewKey, t.previewLines = key, lines
+	return lines
+}
+
+// fit expands tabs, replaces other control characters with '?' so that a
+// searched file can't send escape sequences to the terminal, and truncates s
+// to width columns, counting wide characters as two.
+func fit(s string, width int) string {
+	s = strings.ReplaceAll(s, "\t", "    ")
+	s = strings.Map(func(r rune) rune {
+		if r < 0x20 || (r >= 0x7f && r <= 0x9f) {
+			return '?'
+		}
+		return r
+	}, s)
+
+	used := 0
+	for i, r := range s {
+		used += runeWidth(r)
+		if used > width {
+			return s[:i]
+		}
+	}
+	return s
+}
+
+func pad(s string, width int) string {
+	if n := displayWidth(s); n < width {
+		return s + strings.Repeat(" ", width-n)
+	}
+	return s
+}
@@ -0,0 +1,137 @@
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// defaultFileTypes maps a file type name to the globs that select it.
+// Globs are matched against the base name of each file.
+var defaultFileTypes = map[string][]string{
+	"c":      {"*.c", "*.h"},
+	"cpp":    {"*.cpp", "*.cc", "*.cxx", "*.hpp", "*.hh", "*.hxx"},
+	"css":    {"*.css", "*.scss"},
+	"csv":    {"*.csv"},
+	"docker": {"Dockerfile", "*.dockerfile"},
+	"go":     {"*.go"},
+	"html":   {"*.html", "*.htm"},
+	"java":   {"*.java"},
+	"js":     {"*.js", "*.jsx", "*.mjs", "*.cjs"},
+	"json":   {"*.json", "*.jsonl"},
+	"log":    {"*.log"},
+	"make":   {"Makefile", "makefile", "GNUmakefile", "*.mk"},
+	"md":     {"*.md", "*.markdown"},
+	"proto":  {"*.proto"},
+	"py":     {"*.py", "*.pyi"},
+	"rb":     {"*.rb"},
+	"rust":   {"*.rs"},
+	"sh":     {"*.sh", "*.bash", "*.zsh"},
+	"sql":    {"*.sql"},
+	"toml":   {"*.toml"},
+	"ts":     {"*.ts", "*.tsx"},
+	"txt":    {"*.txt"},
+	"xml":    {"*.xml"},
+	"yaml":   {"*.yaml", "*.yml"},
+}
+
+// fileTypeFilter decides which files recursiveSearch reads based on the
+// -t and -T flags. A nil filter allows every file.
+type fileTypeFilter struct {
+	include []string
+	exclude []string
+}
+
+// newTypeRegistry returns the built-in types extended with --type-add
+// definitions of the form "name:glob[,glob...]".
+func newTypeRegistry(additions []string) (map[string][]string, error) {
+	registry := make(map[string][]string, len(defaultFileTypes))
+	for name, globs := range defaultFileTypes {
+		registry[name] = append([]string(nil), globs...)
+	}
+
+	for _, addition := range additions {
+		name, globs, ok := strings.Cut(addition, ":")
+		if !ok || name == "" || globs == "" {
+			return nil, fmt.Errorf("invalid type definition %q: want name:glob", addition)
+		}
+		for _, glob := range strings.Split(globs, ",") {
+			_, err := filepath.Match(glob, "")
+			if err != nil {
+				return nil, fmt.Errorf("invalid glob %q in type %q: %v", glob, name, err)
+			}
+			registry[name] = append(registry[name], glob)
+		}
+	}
+
+	return registry, nil
+}
+
+func newFileTypeFilter(registry map[string][]string, include, exclude []string) (*fileTypeFilter, error) {
+	if len(include) == 0 && len(exclude) == 0 {
+		return nil, nil
+	}
+
+	filter := &fileTypeFilter{}
+	for _, name := range include {
+		globs, ok := registry[name]
+		if !ok {
+			return nil, fmt.Errorf("unrecognized file type: %s", name)
+		}
+		filter.include = append(filter.include, globs...)
+	}
+	for _, name := range exclude {
+		globs, ok := registry[name]
+		if !ok {
+			return nil, fmt.Errorf("unrecognized file type: %s", name)
+		}
+		filter.exclude = append(filter.exclude, globs...)
+	}
+
+	return filter, nil
+}
+
+// allows reports whether path passes the filter. Excludes win over includes.
+func (f *fileTypeFilter) allows(path string) bool {
+	return f.skipReason(path) == ""
+}
+
+// skipReason explains why allows rejects path, or returns "" if it doesn't.
+func (f *fileTypeFilter) skipReason(path string) string {
+	if f == nil {
+		return ""
+	}
+
+	base := filepath.Base(path)
+	if matchesAnyGlob(base, f.exclude) {
+		return "file type excluded by -T"
+	}
+	if len(f.include) == 0 || matchesAnyGlob(base, f.include) {
+		return ""
+	}
+	return "not a file type selected by -t"
+}
+
+func matchesAnyGlob(name string, globs []string) bool {
+	for _, glob := range globs {
+		matched, _ := filepath.Match(glob, name)
+		if matched {
+			return true
+		}
+	}
+	return false
+}
+
+func writeTypeList(w io.Writer, registry map[string][]string) {
+	names := make([]string, 0, len(registry))
+	for name := range registry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		fmt.Fprintf(w, "%s: %s\n", name, strings.Join(registry[name], ", "))
+	}
+}
@@ -0,0 +1,110 @@
+package cmd
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// errDirectoryLoop is passed to the walk callback for a directory that is
+// already one of its own ancestors, which only happens through symlinks.
+var errDirectoryLoop = errors.New("recursive directory loop")
+
+// walkDir behaves like filepath.WalkDir, but can follow symlinks (-L) and stay
+// on the root's file system (--one-file-system). Directories are identified by
+// device and inode, so a symlink back to an ancestor is reported once through
+// errDirectoryLoop instead of being walked forever.
+func walkDir(root string, fn fs.WalkDirFunc) error {
+	info, err := os.Stat(root)
+	if err != nil {
+		return skipToNil(fn(root, nil, err))
+	}
+
+	w := &walker{fn: fn}
+	w.rootID, w.hasRootID = fileIDOf(info)
+
+	return skipToNil(w.walk(root, fs.FileInfoToDirEntry(info), nil))
+}
+
+type walker struct {
+	fn        fs.WalkDirFunc
+	rootID    fileID
+	hasRootID bool
+}
+
+func (w *walker) walk(path string, d fs.DirEntry, ancestors []fileID) error {
+	if !d.IsDir() {
+		return w.fn(path, d, nil)
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return skipDirToNil(w.fn(path, d, err))
+	}
+
+	id, ok := fileIDOf(info)
+	if ok {
+		if oneFileSystem && w.hasRootID && id.dev != w.rootID.dev {
+			debugSkip(path, "on another file system (--one-file-system)")
+			return nil
+		}
+		for _, ancestor := range ancestors {
+			if ancestor == id {
+				return skipDirToNil(w.fn(path, d, &fs.PathError{Op: "walk", Path: path, Err: errDirectoryLoop}))
+			}
+		}
+		ancestors = append(ancestors, id)
+	}
+
+	err = w.fn(path, d, nil)
+	if err != nil {
+		return skipDirToNil(err)
+	}
+
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		return skipDirToNil(w.fn(path, d, err))
+	}
+
+	for _, entry := range entries {
+		child := filepath.Join(path, entry.Name())
+
+		if followSymlinks && entry.Type()&fs.ModeSymlink != 0 {
+			target, err := os.Stat(child)
+			if err != nil {
+				err = w.fn(child, entry, err)
+				if err != nil {
+					return skipDirToNil(err)
+				}
+				continue
+			}
+			entry = fs.FileInfoToDirEntry(target)
+		}
+
+		err := w.walk(child, entry, ancestors)
+		if err == fs.SkipDir {
+			// a file asked to skip the rest of its directory
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func skipDirToNil(err error) error {
+	if err == fs.SkipDir {
+		return nil
+	}
+	return err
+}
+
+func skipToNil(err error) error {
+	if err == fs.SkipDir || err == fs.SkipAll {
+		return nil
+	}
+	return err
+}
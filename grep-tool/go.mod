@@ -3,7 +3,15 @@ module grep-cli
 go 1.24.2
 
 require (
+	github.com/spf13/cobra v1.9.1
+	golang.org/x/sys v0.33.0
+	golang.org/x/term v0.32.0
+)
+
+require (
+	github.com/cpuguy83/go-md2man/v2 v2.0.6 // indirect
 	github.com/inconshreveable/mousetrap v1.1.0 // indirect
-	github.com/spf13/cobra v1.9.1 // indirect
+	github.com/russross/blackfriday/v2 v2.1.0 // indirect
 	github.com/spf13/pflag v1.0.6 // indirect
+	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
@@ -0,0 +1,357 @@
+// Package query parses the boolean search expressions accepted by
+// mygrep --query, such as:
+//
+//	timeout AND db AND NOT retry
+//	"connection reset" OR (refused AND NOT localhost)
+//
+// Terms are matched as substrings of a line. Adjacent terms without an
+// operator are joined with AND. NOT binds tighter than AND, which binds
+// tighter than OR. Keywords must be upper case; quote a phrase to search for
+// one of them literally.
+package query
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Node is an element of a parsed query.
+type Node interface {
+	// Match reports whether line satisfies the node.
+	Match(line string) bool
+	// String renders the node back into query syntax, fully parenthesised.
+	String() string
+}
+
+// Term matches lines containing Text.
+type Term struct {
+	Text string
+}
+
+// And matches lines satisfying both operands.
+type And struct {
+	Left, Right Node
+}
+
+// Or matches lines satisfying either operand.
+type Or struct {
+	Left, Right Node
+}
+
+// Not matches lines that do not satisfy its operand.
+type Not struct {
+	Operand Node
+}
+
+func (t *Term) Match(line string) bool { return strings.Contains(line, t.Text) }
+func (a *And) Match(line string) bool  { return a.Left.Match(line) && a.Right.Match(line) }
+func (o *Or) Match(line string) bool   { return o.Left.Match(line) || o.Right.Match(line) }
+func (n *Not) Match(line string) bool  { return !n.Operand.Match(line) }
+
+func (t *Term) String() string {
+	if t.Text == "" || isKeyword(t.Text) || strings.IndexFunc(t.Text, isSpecial) >= 0 {
+		return quote(t.Text)
+	}
+	return t.Text
+}
+
+func (a *And) String() string { return "(" + a.Left.String() + " AND " + a.Right.String() + ")" }
+func (o *Or) String() string  { return "(" + o.Left.String() + " OR " + o.Right.String() + ")" }
+func (n *Not) String() string { return "NOT " + n.Operand.String() }
+
+// Lower returns a copy of n with every term lower-cased, for matching lines
+// that the caller has lower-cased for a case-insensitive search.
+func Lower(n Node) Node {
+	switch n := n.(type) {
+	case *Term:
+		return &Term{Text: strings.ToLower(n.Text)}
+	case *And:
+		return &And{Left: Lower(n.Left), Right: Lower(n.Right)}
+	case *Or:
+		return &Or{Left: Lower(n.Left), Right: Lower(n.Right)}
+	case *Not:
+		return &Not{Operand: Lower(n.Operand)}
+	}
+	return n
+}
+
+// SyntaxError reports an invalid query and where in it the problem is.
+type SyntaxError struct {
+	Input  string
+	Column int // 1-based, counted in characters
+	Msg    string
+}
+
+func (e *SyntaxError) Error() string {
+	return fmt.Sprintf("column %d: %s", e.Column, e.Msg)
+}
+
+// Caret returns the query followed by a line with a caret under the
+// offending column.
+func (e *SyntaxError) Caret() string {
+	return e.Input + "\n" + strings.Repeat(" ", e.Column-1) + "^"
+}
+
+// Parse parses a query expression.
+func Parse(input string) (Node, error) {
+	tokens, err := tokenize(input)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &parser{input: input, tokens: tokens}
+	if p.peek().kind == tokenEOF {
+		return nil, p.errorAt(p.peek(), "empty query")
+	}
+
+	node, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+
+	next := p.peek()
+	if next.kind != tokenEOF {
+		return nil, p.errorAt(next, "unexpected "+next.describe())
+	}
+	return node, nil
+}
+
+type tokenKind int
+
+const (
+	tokenEOF tokenKind = iota
+	tokenWord
+	tokenPhrase
+	tokenAnd
+	tokenOr
+	tokenNot
+	tokenLParen
+	tokenRParen
+)
+
+type token struct {
+	kind   tokenKind
+	text   string
+	offset int // byte offset into the input
+}
+
+func (t token) describe() string {
+	switch t.kind {
+	case tokenEOF:
+		return "end of query"
+	case tokenAnd, tokenOr, tokenNot:
+		return t.text
+	case tokenLParen:
+		return "'('"
+	case tokenRParen:
+		return "')'"
+	}
+	return fmt.Sprintf("term %q", t.text)
+}
+
+func isKeyword(word string) bool {
+	return word == "AND" || word == "OR" || word == "NOT"
+}
+
+func isSpecial(r rune) bool {
+	return unicode.IsSpace(r) || r == '(' || r == ')' || r == '"' || r == '\\'
+}
+
+func quote(s string) string {
+	var b strings.Builder
+	b.WriteByte('"')
+	for _, r := range s {
+		if r == '"' || r == '\\' {
+			b.WriteByte('\\')
+		}
+		b.WriteRune(r)
+	}
+	b.WriteByte('"')
+	return b.String()
+}
+
+func tokenize(input string) ([]token, error) {
+	var tokens []token
+
+	i := 0
+	for i < len(input) {
+		r, size := utf8.DecodeRuneInString(input[i:])
+
+		switch {
+		case unicode.IsSpace(r):
+			i += size
+
+		case r == '(':
+			tokens = append(tokens, token{kind: tokenLParen, text: "(", offset: i})
+			i += size
+
+		case r == ')':
+			tokens = append(tokens, token{kind: tokenRParen, text: ")", offset: i})
+			i += size
+
+		case r == '"':
+			start := i
+			var b strings.Builder
+			i += size
+			closed := false
+			for i < len(input) {
+				r, size := utf8.DecodeRuneInString(input[i:])
+				i += size
+				if r == '"' {
+					closed = true
+					break
+				}
+				if r == '\\' && i < len(input) {
+					r, size = utf8.DecodeRuneInString(input[i:])
+					b.WriteString(input[i : i+size])
+					i += size
+					continue
+				}
+				b.WriteString(input[i-size : i])
+			}
+			if !closed {
+				return nil, newSyntaxError(input, start, "unterminated quoted phrase")
+			}
+			if b.Len() == 0 {
+				return nil, newSyntaxError(input, start, "empty quoted phrase")
+			}
+			tokens = append(tokens, token{kind: tokenPhrase, text: b.String(), offset: start})
+
+		default:
+			start := i
+			for i < len(input) {
+				r, size := utf8.DecodeRuneInString(input[i:])
+				if isSpecial(r) && r != '\\' {
+					break
+				}
+				i += size
+			}
+			word := input[start:i]
+			kind := tokenWord
+			switch word {
+			case "AND":
+				kind = tokenAnd
+			case "OR":
+				kind = tokenOr
+			case "NOT":
+				kind = tokenNot
+			}
+			tokens = append(tokens, token{kind: kind, text: word, offset: start})
+		}
+	}
+
+	tokens = append(tokens, token{kind: tokenEOF, offset: len(input)})
+	return tokens, nil
+}
+
+func newSyntaxError(input string, offset int, msg string) *SyntaxError {
+	return &SyntaxError{
+		Input:  input,
+		Column: utf8.RuneCountInString(input[:offset]) + 1,
+		Msg:    msg,
+	}
+}
+
+type parser struct {
+	input  string
+	tokens []token
+	pos    int
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *parser) next() token {
+	t := p.tokens[p.pos]
+	if t.kind != tokenEOF {
+		p.pos++
+	}
+	return t
+}
+
+func (p *parser) errorAt(t token, msg string) error {
+	return newSyntaxError(p.input, t.offset, msg)
+}
+
+// parseOr parses: and { OR and }
+func (p *parser) parseOr() (Node, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+
+	for p.peek().kind == tokenOr {
+		p.next()
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = &Or{Left: left, Right: right}
+	}
+	return left, nil
+}
+
+// parseAnd parses: not { [AND] not }
+func (p *parser) parseAnd() (Node, error) {
+	left, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		switch p.peek().kind {
+		case tokenAnd:
+			p.next()
+		case tokenWord, tokenPhrase, tokenNot, tokenLParen:
+			// implicit AND between adjacent operands
+		default:
+			return left, nil
+		}
+
+		right, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		left = &And{Left: left, Right: right}
+	}
+}
+
+// parseNot parses: NOT not | primary
+func (p *parser) parseNot() (Node, error) {
+	if p.peek().kind == tokenNot {
+		p.next()
+		operand, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return &Not{Operand: operand}, nil
+	}
+	return p.parsePrimary()
+}
+
+// parsePrimary parses: term | phrase | ( or )
+func (p *parser) parsePrimary() (Node, error) {
+	t := p.next()
+	switch t.kind {
+	case tokenWord, tokenPhrase:
+		return &Term{Text: t.text}, nil
+
+	case tokenLParen:
+		node, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		closing := p.peek()
+		if closing.kind != tokenRParen {
+			return nil, p.errorAt(closing, "expected ')' to close '(' at column "+
+				fmt.Sprint(utf8.RuneCountInString(p.input[:t.offset])+1)+", found "+closing.describe())
+		}
+		p.next()
+		return node, nil
+	}
+
+	return nil, p.errorAt(t, "expected a term, phrase or '(', found "+t.describe())
+}
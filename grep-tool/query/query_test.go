@@ -0,0 +1,155 @@
+package query
+
+import (
+	"errors"
+	"testing"
+	"unicode/utf8"
+)
+
+type matchTestCase struct {
+	query string
+	line  string
+	want  bool
+}
+
+var matchTestCases = []matchTestCase{
+	{query: "timeout", line: "db timeout", want: true},
+	{query: "timeout AND db", line: "db timeout", want: true},
+	{query: "timeout AND db", line: "timeout", want: false},
+	{query: "timeout db", line: "db timeout", want: true},
+	{query: "timeout AND db AND NOT retry", line: "db timeout, retry 3", want: false},
+	{query: "timeout AND db AND NOT retry", line: "db timeout, giving up", want: true},
+	{query: "refused OR reset", line: "connection reset", want: true},
+	{query: "a OR b AND c", line: "a", want: true},
+	{query: "(a OR b) AND c", line: "a", want: false},
+	{query: `"connection reset" AND NOT (localhost OR 127.0.0.1)`, line: "connection reset by 10.0.0.1", want: true},
+	{query: `"connection reset" AND NOT (localhost OR 127.0.0.1)`, line: "connection reset by localhost", want: false},
+	{query: `"AND"`, line: "A AND B", want: true},
+	{query: `"say \"hi\""`, line: `they say "hi"`, want: true},
+	{query: "NOT NOT x", line: "x", want: true},
+	{query: "and", line: "this and that", want: true},
+}
+
+func TestMatch(t *testing.T) {
+	for _, testCase := range matchTestCases {
+		node, err := Parse(testCase.query)
+		if err != nil {
+			t.Errorf("Parse(%q) error = %v", testCase.query, err)
+			continue
+		}
+		got := node.Match(testCase.line)
+		if got != testCase.want {
+			t.Errorf("Parse(%q).Match(%q) = %v, want %v", testCase.query, testCase.line, got, testCase.want)
+		}
+	}
+}
+
+func TestString(t *testing.T) {
+	node, err := Parse(`a b OR NOT "c d" AND (e OR "OR")`)
+	if err != nil {
+		t.Fatalf("Parse() error = %v", err)
+	}
+
+	want := `((a AND b) OR (NOT "c d" AND (e OR "OR")))`
+	if got := node.String(); got != want {
+		t.Errorf("String() = %s, want %s", got, want)
+	}
+}
+
+func TestLower(t *testing.T) {
+	node, err := Parse(`Timeout AND NOT "DB Down"`)
+	if err != nil {
+		t.Fatalf("Parse() error = %v", err)
+	}
+
+	lower := Lower(node)
+	if !lower.Match("timeout while connecting") {
+		t.Errorf("Lower() did not lower-case terms: %s", lower)
+	}
+	if node.Match("timeout while connecting") {
+		t.Errorf("Lower() modified the original node: %s", node)
+	}
+}
+
+type syntaxErrorTestCase struct {
+	query      string
+	wantColumn int
+}
+
+var syntaxErrorTestCases = []syntaxErrorTestCase{
+	{query: "", wantColumn: 1},
+	{query: "   ", wantColumn: 4},
+	{query: "timeout AND", wantColumn: 12},
+	{query: "timeout AND OR db", wantColumn: 13},
+	{query: "(timeout OR db", wantColumn: 15},
+	{query: "timeout)", wantColumn: 8},
+	{query: `db AND "unterminated`, wantColumn: 8},
+	{query: `db AND ""`, wantColumn: 8},
+	{query: "()", wantColumn: 2},
+	{query: "NOT", wantColumn: 4},
+	{query: "héllo AND )", wantColumn: 11},
+}
+
+func TestSyntaxErrors(t *testing.T) {
+	for _, testCase := range syntaxErrorTestCases {
+		_, err := Parse(testCase.query)
+
+		var syntaxErr *SyntaxError
+		if !errors.As(err, &syntaxErr) {
+			t.Errorf("Parse(%q) error = %v, want a *SyntaxError", testCase.query, err)
+			continue
+		}
+		if syntaxErr.Column != testCase.wantColumn {
+			t.Errorf("Parse(%q) error at column %d, want %d (%v)", testCase.query, syntaxErr.Column, testCase.wantColumn, err)
+		}
+	}
+}
+
+func TestCaret(t *testing.T) {
+	_, err := Parse("a AND OR b")
+
+	var syntaxErr *SyntaxError
+	if !errors.As(err, &syntaxErr) {
+		t.Fatalf("Parse() error = %v, want a *SyntaxError", err)
+	}
+
+	want := "a AND OR b\n      ^"
+	if got := syntaxErr.Caret(); got != want {
+		t.Errorf("Caret() =\n%s\nwant\n%s", got, want)
+	}
+}
+
+func FuzzParse(f *testing.F) {
+	for _, testCase := range matchTestCases {
+		f.Add(testCase.query)
+	}
+	for _, testCase := range syntaxErrorTestCases {
+		f.Add(testCase.query)
+	}
+
+	f.Fuzz(func(t *testing.T, input string) {
+		node, err := Parse(input)
+		if err != nil {
+			var syntaxErr *SyntaxError
+			if !errors.As(err, &syntaxErr) {
+				t.Fatalf("Parse(%q) returned %T, want *SyntaxError", input, err)
+			}
+			if syntaxErr.Column < 1 || syntaxErr.Column > utf8.RuneCountInString(input)+1 {
+				t.Fatalf("Parse(%q) error column %d out of range", input, syntaxErr.Column)
+			}
+			return
+		}
+
+		// the rendered form must parse back to the same tree
+		rendered := node.String()
+		again, err := Parse(rendered)
+		if err != nil {
+			t.Fatalf("Parse(%q) of rendered %q failed: %v", input, rendered, err)
+		}
+		if again.String() != rendered {
+			t.Fatalf("round trip of %q changed %q to %q", input, rendered, again.String())
+		}
+
+		node.Match(input)
+	})
+}
@@ -1,144 +1,388 @@
 package main
 
 import (
-	"bufio"
-	"bytes"
 	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"os"
-	"sync"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"unicode"
+	"unicode/utf8"
 )
 
 type totalCounts struct {
 	lineCount int
 	wordCount int
 	charCount int
+	byteCount int
+	// maxLineLength is the display width of the longest line
+	maxLineLength int
 }
 
 type flags struct {
-	lineFlag bool
-	wordFlag bool
-	charFlag bool
+	lineFlag    bool
+	wordFlag    bool
+	charFlag    bool
+	byteFlag    bool
+	maxLineFlag bool
+	encoding    encoding
+	recursive   bool
+	include     globList
+	exclude     globList
 }
 
-var mu sync.Mutex
+// globList collects the patterns of a repeatable glob flag.
+type globList []string
+
+func (g *globList) String() string {
+	return strings.Join(*g, ",")
+}
+
+func (g *globList) Set(pattern string) error {
+	if _, err := filepath.Match(pattern, ""); err != nil {
+		return fmt.Errorf("bad glob %q: %v", pattern, err)
+	}
+	*g = append(*g, pattern)
+	return nil
+}
+
+// matches reports whether name matches any of the patterns.
+func (g globList) matches(name string) bool {
+	for _, pattern := range g {
+		if matched, _ := filepath.Match(pattern, name); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// check rejects flags that only make sense together with another.
+func (f *flags) check() error {
+	if !f.recursive && (len(f.include) > 0 || len(f.exclude) > 0) {
+		return errors.New("--include and --exclude require -r")
+	}
+	return nil
+}
+
+// setDefaults selects lines, words and bytes when no count was asked for,
+// like POSIX wc.
+func (f *flags) setDefaults() {
+	if !f.lineFlag && !f.wordFlag && !f.charFlag && !f.byteFlag && !f.maxLineFlag {
+		f.lineFlag, f.wordFlag, f.byteFlag = true, true, true
+	}
+}
 
 func main() {
 	var osExitCode int
 	allFlags := flags{}
-	totals := totalCounts{}
 
 	flag.BoolVar(&allFlags.lineFlag, "l", false, "Count lines")
 	flag.BoolVar(&allFlags.wordFlag, "w", false, "Count words")
-	flag.BoolVar(&allFlags.charFlag, "c", false, "Count characters")
+	flag.BoolVar(&allFlags.charFlag, "m", false, "Count characters")
+	flag.BoolVar(&allFlags.byteFlag, "c", false, "Count bytes")
+	flag.BoolVar(&allFlags.maxLineFlag, "L", false, "Print the display width of the longest line")
+	flag.BoolVar(&allFlags.maxLineFlag, "max-line-length", false, "Same as -L")
+	encodingName := flag.String("encoding", "", "Character encoding for -m and word splitting: utf-8, latin1 or ascii (default from LC_ALL, LC_CTYPE or LANG)")
+	files0From := flag.String("files0-from", "", "Count the files named in `F`, separated by NUL characters; - reads the names from stdin")
+	flag.BoolVar(&allFlags.recursive, "r", false, "Count the files in directories and their subdirectories")
+	flag.BoolVar(&allFlags.recursive, "recursive", false, "Same as -r")
+	flag.Var(&allFlags.include, "include", "With -r, count only files whose name matches `GLOB` (repeatable)")
+	flag.Var(&allFlags.exclude, "exclude", "With -r, skip files and directories whose name matches `GLOB` (repeatable)")
 	flag.Parse()
 
-	if flag.NArg() == 0 {
-		readFromStdin(&allFlags)
-		os.Exit(osExitCode)
-		// fmt.Fprintf(os.Stderr, "Usage: %s [-l | -w | -c] <filename>\n", os.Args[0])
-		// flag.PrintDefaults()
-		// os.Exit(1)
-	}
-
-	if !allFlags.lineFlag && !allFlags.wordFlag && !allFlags.charFlag {
-		allFlags.lineFlag, allFlags.wordFlag, allFlags.charFlag = true, true, true
-	}
-
-	var wg sync.WaitGroup
-
-	for _, filePath := range flag.Args() {
-		wg.Add(1)
-		go func(path string) {
-			defer wg.Done()
-			output, errMsg, exitCode := evaluateFile(path, &allFlags, &totals)
-			if exitCode != 0 {
-				mu.Lock()
-				fmt.Fprint(os.Stderr, errMsg)
-				osExitCode = exitCode
-				mu.Unlock()
-			} else {
-				mu.Lock()
-				fmt.Print(output)
-				mu.Unlock()
-			}
-		}(filePath)
+	if err := allFlags.check(); err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", os.Args[0], err)
+		os.Exit(1)
 	}
 
-	wg.Wait()
+	var err error
+	if *encodingName != "" {
+		allFlags.encoding, err = parseEncoding(*encodingName)
+	} else {
+		allFlags.encoding = localeEncoding()
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", os.Args[0], err)
+		os.Exit(1)
+	}
 
-	if flag.NArg() > 1 {
-		printAllCounts(&allFlags, &totals)
-		fmt.Println(" total")
+	paths := flag.Args()
+	if *files0From != "" {
+		if len(paths) > 0 {
+			fmt.Fprintf(os.Stderr, "%s: extra operand %s: file operands cannot be combined with --files0-from\n", os.Args[0], paths[0])
+			os.Exit(1)
+		}
+		paths, err = readFiles0From(*files0From, os.Stdin)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", os.Args[0], err)
+			os.Exit(1)
+		}
+	} else if flag.NArg() == 0 {
+		if allFlags.recursive {
+			paths = []string{"."}
+		} else {
+			osExitCode = readFromStdin(os.Stdin, &allFlags, os.Stdout, os.Stderr)
+			os.Exit(osExitCode)
+			// fmt.Fprintf(os.Stderr, "Usage: %s [-l | -w | -c] <filename>\n", os.Args[0])
+			// flag.PrintDefaults()
+			// os.Exit(1)
+		}
 	}
 
+	allFlags.setDefaults()
+
+	if allFlags.recursive {
+		paths, osExitCode = expandPaths(paths, &allFlags, os.Stderr)
+	}
+	if exitCode := countFiles(paths, &allFlags, os.Stdout, os.Stderr); exitCode != 0 {
+		osExitCode = exitCode
+	}
 	os.Exit(osExitCode)
 }
 
-func printAllCounts(allFlags *flags, totalCounts *totalCounts) {
-	if allFlags.lineFlag {
-		fmt.Printf("%8d", totalCounts.lineCount)
+// readFiles0From reads the NUL-separated file names in name, or in stdin
+// when name is "-". A final NUL is optional.
+func readFiles0From(name string, stdin io.Reader) ([]string, error) {
+	input := stdin
+	if name != "-" {
+		file, err := os.Open(name)
+		if err != nil {
+			return nil, fmt.Errorf("cannot open %s for reading: %v", name, err)
+		}
+		defer file.Close()
+		input = file
 	}
-	if allFlags.wordFlag {
-		fmt.Printf("%8d", totalCounts.wordCount)
+
+	data, err := io.ReadAll(input)
+	if err != nil {
+		return nil, fmt.Errorf("%s: read error: %v", name, err)
 	}
-	if allFlags.charFlag {
-		fmt.Printf("%8d", totalCounts.charCount)
+	if len(data) == 0 {
+		return nil, nil
 	}
+
+	paths := strings.Split(strings.TrimSuffix(string(data), "\x00"), "\x00")
+	for i, path := range paths {
+		if path == "" {
+			return nil, fmt.Errorf("%s:%d: invalid zero-length file name", name, i+1)
+		}
+	}
+	return paths, nil
 }
 
-func evaluateFile(filePath string, allFlags *flags, totals *totalCounts) (output string, errMsg string, exitCode int) {
-	const errorCode = 1
-	const successCode = 0
-	const emptyString = ""
+// expandPaths replaces each directory in paths with the regular files under
+// it, in lexical order. Files and directories whose name matches --exclude
+// are skipped, and with --include only files matching it are kept. Files
+// named in paths themselves are always kept. Directories that can't be read
+// are reported to stderr and make the exit code 1. A directory operand may
+// be a symlink; links found inside it are not followed.
+func expandPaths(paths []string, allFlags *flags, stderr io.Writer) ([]string, int) {
+	var osExitCode int
+	var files []string
+
+	for _, root := range paths {
+		info, err := os.Stat(root)
+		if err != nil || !info.IsDir() {
+			// counting it reports the error
+			files = append(files, root)
+			continue
+		}
 
-	file, errMsg, exitCode := validateFile(filePath)
-	if exitCode != successCode {
-		return emptyString, errMsg, exitCode
+		// WalkDir doesn't follow a symlinked root, so walk its target and
+		// name the files under the operand as given
+		walkRoot, err := filepath.EvalSymlinks(root)
+		if err != nil {
+			fmt.Fprintf(stderr, "%s: %v\n", os.Args[0], err)
+			osExitCode = 1
+			continue
+		}
+
+		filepath.WalkDir(walkRoot, func(path string, entry os.DirEntry, err error) error {
+			if rel, relErr := filepath.Rel(walkRoot, path); relErr == nil {
+				path = filepath.Join(root, rel)
+			}
+			if err != nil {
+				// the error names the target; report the path as given
+				var pathErr *os.PathError
+				if errors.As(err, &pathErr) {
+					err = pathErr.Err
+				}
+				fmt.Fprintf(stderr, "%s: %s: %v\n", os.Args[0], path, err)
+				osExitCode = 1
+				return nil
+			}
+			if entry.IsDir() {
+				if path != filepath.Clean(root) && allFlags.exclude.matches(entry.Name()) {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			// like symlinks, devices and sockets, anything that isn't a
+			// regular file is left out
+			if !entry.Type().IsRegular() || allFlags.exclude.matches(entry.Name()) {
+				return nil
+			}
+			if len(allFlags.include) > 0 && !allFlags.include.matches(entry.Name()) {
+				return nil
+			}
+			files = append(files, path)
+			return nil
+		})
 	}
-	defer file.Close()
+	return files, osExitCode
+}
 
-	var result string
+// fileResult is what evaluateFile found for one file.
+type fileResult struct {
+	counts   totalCounts
+	errMsg   string
+	exitCode int
+}
 
-	if allFlags.lineFlag {
-		lineCount, err := lineCounter(file)
-		if err != nil {
-			return emptyString, fmt.Sprintf("Error reading lines from %s: %v\n", filePath, err), errorCode
+// countWorkers bounds how many files countFiles reads at once.
+var countWorkers = runtime.NumCPU()
+
+// countFiles counts the files concurrently, on at most countWorkers
+// goroutines, but writes their counts to stdout in argument order, followed
+// by a total when there is more than one file, or always with -r. It
+// returns the exit code of the last file that failed.
+func countFiles(paths []string, allFlags *flags, stdout, stderr io.Writer) int {
+	var osExitCode int
+	totals := totalCounts{}
+
+	inputs := make([]os.FileInfo, len(paths))
+	for i, path := range paths {
+		// a file that can't be stat'ed is reported by evaluateFile
+		inputs[i], _ = os.Stat(path)
+	}
+	width := numberWidth(allFlags, inputs)
+
+	results := make([]chan fileResult, len(paths))
+	for i := range results {
+		results[i] = make(chan fileResult, 1)
+	}
+
+	jobs := make(chan int)
+	go func() {
+		for i := range paths {
+			jobs <- i
 		}
-		mu.Lock()
-		totals.lineCount += lineCount
-		mu.Unlock()
-		result += fmt.Sprintf("%8d", lineCount)
-		file.Seek(0, io.SeekStart)
+		close(jobs)
+	}()
+	for range min(countWorkers, len(paths)) {
+		go func() {
+			for i := range jobs {
+				counts, errMsg, exitCode := evaluateFile(paths[i], allFlags)
+				results[i] <- fileResult{counts, errMsg, exitCode}
+			}
+		}()
 	}
 
-	if allFlags.wordFlag {
-		wordCount, err := wordCounter(file)
-		if err != nil {
-			return emptyString, fmt.Sprintf("Error reading words from %s: %v\n", filePath, err), errorCode
+	for i, result := range results {
+		r := <-result
+		if r.exitCode != 0 {
+			fmt.Fprint(stderr, r.errMsg)
+			osExitCode = r.exitCode
+			continue
 		}
-		mu.Lock()
-		totals.wordCount += wordCount
-		mu.Unlock()
-		result += fmt.Sprintf("%8d", wordCount)
-		file.Seek(0, io.SeekStart)
+		totals.add(r.counts)
+		fmt.Fprintf(stdout, "%s %s\n", formatCounts(allFlags, &r.counts, width), paths[i])
 	}
 
-	if allFlags.charFlag {
-		charCount, err := charCounter(file)
-		if err != nil {
-			return emptyString, fmt.Sprintf("Error reading characters from %s: %v\n", filePath, err), errorCode
+	if len(paths) > 1 || allFlags.recursive {
+		fmt.Fprintf(stdout, "%s total\n", formatCounts(allFlags, &totals, width))
+	}
+	return osExitCode
+}
+
+// add adds other's counts to c, keeping the longer of the longest lines.
+func (c *totalCounts) add(other totalCounts) {
+	c.lineCount += other.lineCount
+	c.wordCount += other.wordCount
+	c.charCount += other.charCount
+	c.byteCount += other.byteCount
+	c.maxLineLength = max(c.maxLineLength, other.maxLineLength)
+}
+
+// numberWidth returns the column width GNU wc would use for inputs, whose
+// entries are nil for files that can't be stat'ed: wide enough for the
+// total size of the regular files, at least 7 if any input isn't a regular
+// file, whose size isn't known in advance, and 1 for a single count of a
+// single input.
+func numberWidth(allFlags *flags, inputs []os.FileInfo) int {
+	selected := 0
+	for _, on := range []bool{allFlags.lineFlag, allFlags.wordFlag, allFlags.charFlag, allFlags.byteFlag, allFlags.maxLineFlag} {
+		if on {
+			selected++
 		}
-		mu.Lock()
-		totals.charCount += charCount
-		mu.Unlock()
-		result += fmt.Sprintf("%8d", charCount)
+	}
+	if selected == 1 && len(inputs) == 1 {
+		return 1
 	}
 
-	result += fmt.Sprintf(" %s\n", filePath)
-	return result, emptyString, successCode
+	width, minimum := 1, 1
+	var regularTotal int64
+	for _, info := range inputs {
+		if info == nil {
+			continue
+		}
+		if info.Mode().IsRegular() {
+			regularTotal += info.Size()
+		} else {
+			minimum = 7
+		}
+	}
+	for ; regularTotal >= 10; regularTotal /= 10 {
+		width++
+	}
+	return max(width, minimum)
+}
+
+// formatCounts lays out the selected counts in columns of the given width,
+// separated by single spaces, in the order lines, words, characters, bytes
+// and longest line.
+func formatCounts(allFlags *flags, counts *totalCounts, width int) string {
+	var columns []string
+	if allFlags.lineFlag {
+		columns = append(columns, fmt.Sprintf("%*d", width, counts.lineCount))
+	}
+	if allFlags.wordFlag {
+		columns = append(columns, fmt.Sprintf("%*d", width, counts.wordCount))
+	}
+	if allFlags.charFlag {
+		columns = append(columns, fmt.Sprintf("%*d", width, counts.charCount))
+	}
+	if allFlags.byteFlag {
+		columns = append(columns, fmt.Sprintf("%*d", width, counts.byteCount))
+	}
+	if allFlags.maxLineFlag {
+		columns = append(columns, fmt.Sprintf("%*d", width, counts.maxLineLength))
+	}
+	return strings.Join(columns, " ")
+}
+
+func printAllCounts(w io.Writer, allFlags *flags, totalCounts *totalCounts, width int) {
+	fmt.Fprint(w, formatCounts(allFlags, totalCounts, width))
+}
+
+func evaluateFile(filePath string, allFlags *flags) (counts totalCounts, errMsg string, exitCode int) {
+	const errorCode = 1
+	const successCode = 0
+
+	file, errMsg, exitCode := validateFile(filePath)
+	if exitCode != successCode {
+		return totalCounts{}, errMsg, exitCode
+	}
+	defer file.Close()
+
+	counts, err := countReader(file, allFlags.encoding)
+	if err != nil {
+		return totalCounts{}, fmt.Sprintf("Error reading %s: %v\n", filePath, err), errorCode
+	}
+	return counts, "", successCode
 }
 
 func validateFile(filePath string) (*os.File, string, int) {
@@ -154,6 +398,13 @@ func validateFile(filePath string) (*os.File, string, int) {
 		if errors.Is(err, os.ErrPermission) {
 			return nil, fmt.Sprintf("%s: %s: open: Permission denied\n", os.Args[0], filePath), errorCode
 		}
+		// such as a symlink loop or a name too long; the error names the
+		// path itself, so report only its cause
+		var pathErr *os.PathError
+		if errors.As(err, &pathErr) {
+			err = pathErr.Err
+		}
+		return nil, fmt.Sprintf("%s: %s: %v\n", os.Args[0], filePath, err), errorCode
 	}
 
 	info, _ := file.Stat()
@@ -165,75 +416,390 @@ func validateFile(filePath string) (*os.File, string, int) {
 	return file, emptyString, successCode
 }
 
-func lineCounter(file io.Reader) (int, error) {
-	return genericCounter(file, bufio.ScanLines)
+// encoding decides what counts as a character and as white space.
+type encoding int
+
+const (
+	encodingUTF8 encoding = iota
+	// encodingASCII is the C locale: every byte is one character and only
+	// ASCII white space separates words
+	encodingASCII
+	// encodingLatin1 is ISO-8859-1: every byte is one character
+	encodingLatin1
+)
+
+// parseEncoding accepts an --encoding value or a locale's codeset, in any
+// case and with or without dashes and underscores.
+func parseEncoding(name string) (encoding, error) {
+	switch strings.NewReplacer("-", "", "_", "").Replace(strings.ToLower(name)) {
+	case "utf8":
+		return encodingUTF8, nil
+	case "ascii", "usascii", "ansix3.41968", "c", "posix":
+		return encodingASCII, nil
+	case "latin1", "iso88591", "l1":
+		return encodingLatin1, nil
+	}
+	return encodingUTF8, fmt.Errorf("unsupported encoding %q: use utf-8, latin1 or ascii", name)
 }
 
-func wordCounter(file io.Reader) (int, error) {
-	return genericCounter(file, bufio.ScanWords)
+// localeEncoding returns the encoding of the locale set by LC_ALL, LC_CTYPE
+// or LANG, the first that is set winning. The C and POSIX locales, and no
+// locale at all, count bytes as characters; a locale without a codeset or
+// with one that isn't supported is taken to be UTF-8.
+func localeEncoding() encoding {
+	var locale string
+	for _, name := range []string{"LC_ALL", "LC_CTYPE", "LANG"} {
+		if locale = os.Getenv(name); locale != "" {
+			break
+		}
+	}
+	if locale == "" || locale == "C" || locale == "POSIX" {
+		return encodingASCII
+	}
+
+	// language[_territory][.codeset][@modifier]
+	locale, _, _ = strings.Cut(locale, "@")
+	_, codeset, found := strings.Cut(locale, ".")
+	if !found {
+		return encodingUTF8
+	}
+	enc, err := parseEncoding(codeset)
+	if err != nil {
+		return encodingUTF8
+	}
+	return enc
 }
 
-func charCounter(file io.Reader) (int, error) {
-	return genericCounter(file, bufio.ScanRunes)
+// readBufferSize is how much countReader reads at a time. Memory use stays
+// at this size whatever the length of the input.
+const readBufferSize = 256 * 1024
+
+// countReader computes every count in a single pass over input, so it works
+// on pipes and other inputs that cannot be rewound.
+func countReader(input io.Reader, enc encoding) (totalCounts, error) {
+	c := counter{encoding: enc}
+	buf := make([]byte, readBufferSize)
+	for {
+		n, err := input.Read(buf)
+		c.write(buf[:n])
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return totalCounts{}, err
+		}
+	}
+	return c.finish(), nil
 }
 
-func genericCounter(file io.Reader, split bufio.SplitFunc) (int, error) {
-	count := 0
-	scanner := bufio.NewScanner(file)
-	scanner.Split(split)
+// asciiSpace lists the ASCII bytes unicode.IsSpace reports as white space.
+var asciiSpace = [utf8.RuneSelf]bool{'\t': true, '\n': true, '\v': true, '\f': true, '\r': true, ' ': true}
+
+// tabWidth is the distance between tab stops for -L.
+const tabWidth = 8
+
+// counter accumulates counts over input fed to it in pieces of any size.
+// Lines are counted as newline bytes, like POSIX wc, so text after the last
+// newline adds none. As in GNU wc, words are runs of printable characters
+// separated by white space: control characters are counted as characters
+// but neither start nor end a word. In UTF-8, a byte that isn't part of a
+// valid character is skipped the same way, without being a character.
+type counter struct {
+	encoding encoding
+	counts   totalCounts
+	inWord   bool
+	// linePos is the display width of the current line so far
+	linePos int
+	// partial holds the start of a multi-byte character cut off by the end
+	// of the previous piece
+	partial []byte
+}
 
-	for scanner.Scan() {
-		count++
+func (c *counter) write(p []byte) {
+	if len(p) == 0 {
+		return
 	}
+	c.counts.byteCount += len(p)
 
-	err := scanner.Err()
-	if err != nil {
-		return 0, err
+	if c.encoding != encodingUTF8 {
+		c.writeSingleByte(p)
+		return
+	}
+
+	if len(c.partial) > 0 {
+		// complete the cut-off character from the front of p
+		need := min(utf8.UTFMax-len(c.partial), len(p))
+		joined := append(c.partial, p[:need]...)
+		if !utf8.FullRune(joined) && need == len(p) {
+			c.partial = joined
+			return
+		}
+		r, size := utf8.DecodeRune(joined)
+		// a character that never completed is skipped, leaving the bytes
+		// that broke it to be counted below
+		if r != utf8.RuneError || size > 1 {
+			c.addRune(r)
+			p = p[size-len(c.partial):]
+		}
+		c.partial = c.partial[:0]
 	}
 
-	return count, nil
+	for i := 0; i < len(p); {
+		b := p[i]
+		if b > ' ' && b < 0x7f {
+			// printable and not white space, by far the most common
+			c.counts.charCount++
+			c.linePos++
+			if !c.inWord {
+				c.inWord = true
+				c.counts.wordCount++
+			}
+			i++
+			continue
+		}
+		if b < utf8.RuneSelf {
+			c.addASCII(b)
+			i++
+			continue
+		}
+
+		if !utf8.FullRune(p[i:]) {
+			c.partial = append(c.partial, p[i:]...)
+			return
+		}
+		r, size := utf8.DecodeRune(p[i:])
+		if r != utf8.RuneError || size > 1 {
+			c.addRune(r)
+		}
+		i += size
+	}
 }
 
-func readFromStdin(allFlags *flags) {
-	totalCounts, err := countFromStdin(os.Stdin)
-	if err != nil {
-		fmt.Fprint(os.Stderr, "Error:", err)
-		os.Exit(1)
+// writeSingleByte counts p in an encoding where every byte is a character.
+func (c *counter) writeSingleByte(p []byte) {
+	for _, b := range p {
+		switch {
+		case b < utf8.RuneSelf:
+			c.addASCII(b)
+		case c.encoding == encodingLatin1:
+			c.addRune(rune(b))
+		default:
+			// a byte outside ASCII is a character, but like an invalid
+			// UTF-8 byte it has no width and neither starts nor ends a word
+			c.counts.charCount++
+		}
 	}
+}
 
-	if !allFlags.lineFlag && !allFlags.wordFlag && !allFlags.charFlag {
-		allFlags.lineFlag, allFlags.wordFlag, allFlags.charFlag = true, true, true
+// addASCII counts an ASCII character, which may end a line or move to a tab
+// stop.
+func (c *counter) addASCII(b byte) {
+	switch {
+	case b == '\n':
+		c.counts.lineCount++
+		c.endLine()
+	case b == '\r' || b == '\f':
+		c.endLine()
+	case b == '\t':
+		c.linePos += tabWidth - c.linePos%tabWidth
+	case b >= ' ' && b < 0x7f:
+		c.linePos++
+	}
+	if !asciiSpace[b] && (b < ' ' || b == 0x7f) {
+		// like GNU wc, control characters neither start nor end a word
+		c.counts.charCount++
+		return
 	}
+	c.addChar(asciiSpace[b], 0)
+}
 
-	fmt.Println()
-	printAllCounts(allFlags, &totalCounts)
-	fmt.Println()
+// addRune counts a character outside ASCII.
+func (c *counter) addRune(r rune) {
+	if !printable(r) {
+		c.counts.charCount++
+		return
+	}
+	// GNU wc also separates words at the word joiner
+	c.addChar(unicode.IsSpace(r) || r == '\u2060', runeWidth(r))
 }
 
-func countFromStdin(stdInput io.Reader) (totalCounts, error) {
-	input, err := io.ReadAll(stdInput)
-	if err != nil {
-		return totalCounts{}, err
+// printable reports whether r is printable in the sense of iswprint: any
+// assigned character other than controls and the line and paragraph
+// separators.
+func printable(r rune) bool {
+	// answer the most common scripts without searching tables
+	switch {
+	case r < 0x378:
+		return !unicode.IsControl(r)
+	case 0x3041 <= r && r <= 0x3096, 0x3099 <= r && r <= 0x30ff, 0x4e00 <= r && r <= 0x9fff, 0xac00 <= r && r <= 0xd7a3:
+		return true
 	}
+	return unicode.In(r, unicode.L, unicode.M, unicode.N, unicode.P, unicode.S, unicode.Zs, unicode.Cf, unicode.Co)
+}
 
-	lines, err := lineCounter(bytes.NewReader(input))
-	if err != nil {
-		return totalCounts{}, err
+// addChar counts a character of the given display width, which is either
+// white space or part of a word.
+func (c *counter) addChar(space bool, width int) {
+	c.counts.charCount++
+	c.linePos += width
+	if space {
+		c.inWord = false
+	} else if !c.inWord {
+		c.inWord = true
+		c.counts.wordCount++
 	}
+}
 
-	words, err := wordCounter(bytes.NewReader(input))
-	if err != nil {
-		return totalCounts{}, err
+// finish returns the counts once all input has been written.
+func (c *counter) finish() totalCounts {
+	// an incomplete character at the very end is skipped
+	c.partial = nil
+
+	c.endLine()
+	return c.counts
+}
+
+// endLine records the width of the line that just ended, at a newline,
+// carriage return or form feed, or at the end of input.
+func (c *counter) endLine() {
+	c.counts.maxLineLength = max(c.counts.maxLineLength, c.linePos)
+	c.linePos = 0
+}
+
+// wideChars are the East Asian wide and fullwidth characters, and emoji
+// presented as such, that terminals draw two columns wide.
+var wideChars = &unicode.RangeTable{
+	R16: []unicode.Range16{
+		{Lo: 0x1100, Hi: 0x115f, Stride: 1},
+		{Lo: 0x231a, Hi: 0x231b, Stride: 1},
+		{Lo: 0x2329, Hi: 0x232a, Stride: 1},
+		{Lo: 0x23e9, Hi: 0x23ec, Stride: 1},
+		{Lo: 0x23f0, Hi: 0x23f0, Stride: 1},
+		{Lo: 0x23f3, Hi: 0x23f3, Stride: 1},
+		{Lo: 0x25fd, Hi: 0x25fe, Stride: 1},
+		{Lo: 0x2614, Hi: 0x2615, Stride: 1},
+		{Lo: 0x2648, Hi: 0x2653, Stride: 1},
+		{Lo: 0x267f, Hi: 0x267f, Stride: 1},
+		{Lo: 0x2693, Hi: 0x2693, Stride: 1},
+		{Lo: 0x26a1, Hi: 0x26a1, Stride: 1},
+		{Lo: 0x26aa, Hi: 0x26ab, Stride: 1},
+		{Lo: 0x26bd, Hi: 0x26be, Stride: 1},
+		{Lo: 0x26c4, Hi: 0x26c5, Stride: 1},
+		{Lo: 0x26ce, Hi: 0x26ce, Stride: 1},
+		{Lo: 0x26d4, Hi: 0x26d4, Stride: 1},
+		{Lo: 0x26ea, Hi: 0x26ea, Stride: 1},
+		{Lo: 0x26f2, Hi: 0x26f3, Stride: 1},
+		{Lo: 0x26f5, Hi: 0x26f5, Stride: 1},
+		{Lo: 0x26fa, Hi: 0x26fa, Stride: 1},
+		{Lo: 0x26fd, Hi: 0x26fd, Stride: 1},
+		{Lo: 0x2705, Hi: 0x2705, Stride: 1},
+		{Lo: 0x270a, Hi: 0x270b, Stride: 1},
+		{Lo: 0x2728, Hi: 0x2728, Stride: 1},
+		{Lo: 0x274c, Hi: 0x274c, Stride: 1},
+		{Lo: 0x274e, Hi: 0x274e, Stride: 1},
+		{Lo: 0x2753, Hi: 0x2755, Stride: 1},
+		{Lo: 0x2757, Hi: 0x2757, Stride: 1},
+		{Lo: 0x2795, Hi: 0x2797, Stride: 1},
+		{Lo: 0x27b0, Hi: 0x27b0, Stride: 1},
+		{Lo: 0x27bf, Hi: 0x27bf, Stride: 1},
+		{Lo: 0x2b1b, Hi: 0x2b1c, Stride: 1},
+		{Lo: 0x2b50, Hi: 0x2b50, Stride: 1},
+		{Lo: 0x2b55, Hi: 0x2b55, Stride: 1},
+		{Lo: 0x2e80, Hi: 0x303e, Stride: 1},
+		{Lo: 0x3041, Hi: 0x33ff, Stride: 1},
+		{Lo: 0x3400, Hi: 0x4dbf, Stride: 1},
+		{Lo: 0x4e00, Hi: 0x9fff, Stride: 1},
+		{Lo: 0xa000, Hi: 0xa4cf, Stride: 1},
+		{Lo: 0xa960, Hi: 0xa97f, Stride: 1},
+		{Lo: 0xac00, Hi: 0xd7a3, Stride: 1},
+		{Lo: 0xf900, Hi: 0xfaff, Stride: 1},
+		{Lo: 0xfe10, Hi: 0xfe19, Stride: 1},
+		{Lo: 0xfe30, Hi: 0xfe6f, Stride: 1},
+		{Lo: 0xff00, Hi: 0xff60, Stride: 1},
+		{Lo: 0xffe0, Hi: 0xffe6, Stride: 1},
+	},
+	R32: []unicode.Range32{
+		{Lo: 0x16fe0, Hi: 0x16fe4, Stride: 1},
+		{Lo: 0x17000, Hi: 0x18cff, Stride: 1},
+		{Lo: 0x1b000, Hi: 0x1b2ff, Stride: 1},
+		{Lo: 0x1f004, Hi: 0x1f004, Stride: 1},
+		{Lo: 0x1f0cf, Hi: 0x1f0cf, Stride: 1},
+		{Lo: 0x1f18e, Hi: 0x1f18e, Stride: 1},
+		{Lo: 0x1f191, Hi: 0x1f19a, Stride: 1},
+		{Lo: 0x1f200, Hi: 0x1f251, Stride: 1},
+		{Lo: 0x1f300, Hi: 0x1f320, Stride: 1},
+		{Lo: 0x1f32d, Hi: 0x1f335, Stride: 1},
+		{Lo: 0x1f337, Hi: 0x1f37c, Stride: 1},
+		{Lo: 0x1f37e, Hi: 0x1f393, Stride: 1},
+		{Lo: 0x1f3a0, Hi: 0x1f3ca, Stride: 1},
+		{Lo: 0x1f3cf, Hi: 0x1f3d3, Stride: 1},
+		{Lo: 0x1f3e0, Hi: 0x1f3f0, Stride: 1},
+		{Lo: 0x1f3f4, Hi: 0x1f3f4, Stride: 1},
+		{Lo: 0x1f3f8, Hi: 0x1f43e, Stride: 1},
+		{Lo: 0x1f440, Hi: 0x1f440, Stride: 1},
+		{Lo: 0x1f442, Hi: 0x1f4fc, Stride: 1},
+		{Lo: 0x1f4ff, Hi: 0x1f53d, Stride: 1},
+		{Lo: 0x1f54b, Hi: 0x1f54e, Stride: 1},
+		{Lo: 0x1f550, Hi: 0x1f567, Stride: 1},
+		{Lo: 0x1f57a, Hi: 0x1f57a, Stride: 1},
+		{Lo: 0x1f595, Hi: 0x1f596, Stride: 1},
+		{Lo: 0x1f5a4, Hi: 0x1f5a4, Stride: 1},
+		{Lo: 0x1f5fb, Hi: 0x1f64f, Stride: 1},
+		{Lo: 0x1f680, Hi: 0x1f6c5, Stride: 1},
+		{Lo: 0x1f6cc, Hi: 0x1f6cc, Stride: 1},
+		{Lo: 0x1f6d0, Hi: 0x1f6d2, Stride: 1},
+		{Lo: 0x1f6d5, Hi: 0x1f6d7, Stride: 1},
+		{Lo: 0x1f6dc, Hi: 0x1f6df, Stride: 1},
+		{Lo: 0x1f6eb, Hi: 0x1f6ec, Stride: 1},
+		{Lo: 0x1f6f4, Hi: 0x1f6fc, Stride: 1},
+		{Lo: 0x1f7e0, Hi: 0x1f7eb, Stride: 1},
+		{Lo: 0x1f7f0, Hi: 0x1f7f0, Stride: 1},
+		{Lo: 0x1f90c, Hi: 0x1f93a, Stride: 1},
+		{Lo: 0x1f93c, Hi: 0x1f945, Stride: 1},
+		{Lo: 0x1f947, Hi: 0x1f9ff, Stride: 1},
+		{Lo: 0x1fa70, Hi: 0x1fafc, Stride: 1},
+		{Lo: 0x20000, Hi: 0x2fffd, Stride: 1},
+		{Lo: 0x30000, Hi: 0x3fffd, Stride: 1},
+	},
+}
+
+// runeWidth returns how many columns a terminal draws r in: none for
+// control, combining and format characters, two for wide characters and one
+// for the rest.
+func runeWidth(r rune) int {
+	// answer the most common scripts without searching tables
+	switch {
+	case r < 0x300:
+		if r < 0xa0 || r == 0xad {
+			return 0
+		}
+		return 1
+	case 0x3041 <= r && r <= 0x33ff, 0x4e00 <= r && r <= 0x9fff, 0xac00 <= r && r <= 0xd7a3:
+		return 2
 	}
 
-	chars, err := charCounter(bytes.NewReader(input))
+	switch {
+	case unicode.IsControl(r) || unicode.In(r, unicode.Mn, unicode.Me, unicode.Cf):
+		return 0
+	case unicode.Is(wideChars, r):
+		return 2
+	}
+	return 1
+}
+
+// readFromStdin counts stdin and writes its counts, without a file name, to
+// stdout. It returns the exit code.
+func readFromStdin(stdin *os.File, allFlags *flags, stdout, stderr io.Writer) int {
+	totalCounts, err := countReader(stdin, allFlags.encoding)
 	if err != nil {
-		return totalCounts{}, err
+		fmt.Fprintln(stderr, "Error:", err)
+		return 1
 	}
 
-	return totalCounts{
-		lineCount: lines,
-		wordCount: words,
-		charCount: chars,
-	}, nil
+	allFlags.setDefaults()
+
+	info, _ := stdin.Stat()
+	printAllCounts(stdout, allFlags, &totalCounts, numberWidth(allFlags, []os.FileInfo{info}))
+	fmt.Fprintln(stdout)
+	return 0
 }
@@ -1,9 +1,15 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
+	"flag"
+	"fmt"
+	"io"
 	"os"
+	"path/filepath"
 	"strings"
+	"sync"
 	"testing"
 )
 
@@ -27,8 +33,8 @@ var lineCounterTests = []lineCounterTest{
 	{input: "line1\n", expect: 1},
 	{input: "line1\nline2\n", expect: 2},
 	{input: "line1\nline2\nline3\n", expect: 3},
-	{input: "line1\nline2\nline3", expect: 3},
-	{input: "line1", expect: 1},
+	{input: "line1\nline2\nline3", expect: 2},
+	{input: "line1", expect: 0},
 }
 
 // expectations are set based on the output of wc command
@@ -48,12 +54,12 @@ var charCounterTests = []charCounterTest{
 func TestLineCounter(t *testing.T) {
 	for _, testCase := range lineCounterTests {
 		reader := strings.NewReader(testCase.input)
-		count, err := lineCounter(reader)
+		counts, err := countReader(reader, encodingUTF8)
 		if err != nil {
 			t.Errorf("Unexpected error for input %s: %v", testCase.input, err)
 		}
-		if count != testCase.expect {
-			t.Errorf("Expected %d lines, got %d for input %s", testCase.expect, count, testCase.input)
+		if counts.lineCount != testCase.expect {
+			t.Errorf("Expected %d lines, got %d for input %s", testCase.expect, counts.lineCount, testCase.input)
 		}
 	}
 }
@@ -61,12 +67,12 @@ func TestLineCounter(t *testing.T) {
 func TestWordCounter(t *testing.T) {
 	for _, testCase := range wordCounterTests {
 		reader := strings.NewReader(testCase.input)
-		count, err := wordCounter(reader)
+		counts, err := countReader(reader, encodingUTF8)
 		if err != nil {
 			t.Errorf("Unexpected error for input %s: %v", testCase.input, err)
 		}
-		if count != testCase.expect {
-			t.Errorf("Expected %d words, got %d for input %s", testCase.expect, count, testCase.input)
+		if counts.wordCount != testCase.expect {
+			t.Errorf("Expected %d words, got %d for input %s", testCase.expect, counts.wordCount, testCase.input)
 		}
 	}
 }
@@ -74,12 +80,12 @@ func TestWordCounter(t *testing.T) {
 func TestCharCounter(t *testing.T) {
 	for _, testCase := range charCounterTests {
 		reader := strings.NewReader(testCase.input)
-		count, err := charCounter(reader)
+		counts, err := countReader(reader, encodingUTF8)
 		if err != nil {
 			t.Errorf("Unexpected error for input %s: %v", testCase.input, err)
 		}
-		if count != testCase.expect {
-			t.Errorf("Expected %d characters, got %d for input %s", testCase.expect, count, testCase.input)
+		if counts.charCount != testCase.expect {
+			t.Errorf("Expected %d characters, got %d for input %s", testCase.expect, counts.charCount, testCase.input)
 		}
 	}
 }
@@ -102,11 +108,10 @@ func TestEvaluateFile(t *testing.T) {
 		lineFlag: true,
 		wordFlag: true,
 		charFlag: true,
+		byteFlag: true,
 	}
 
-	totals := totalCounts{}
-
-	result, errMsg, exitCode := evaluateFile(tmpFile.Name(), &allFlags, &totals)
+	totals, errMsg, exitCode := evaluateFile(tmpFile.Name(), &allFlags)
 
 	if exitCode != 0 {
 		t.Errorf("Expected exit code 0, got %d", exitCode)
@@ -114,9 +119,6 @@ func TestEvaluateFile(t *testing.T) {
 	if errMsg != "" {
 		t.Errorf("Expected empty error message, got: %s", errMsg)
 	}
-	if !strings.HasSuffix(result, tmpFile.Name()+"\n") {
-		t.Errorf("Output did not end with filename. Got: %q", result)
-	}
 
 	expectedLineCount := 2
 	expectedWordCount := 5
@@ -131,21 +133,26 @@ func TestEvaluateFile(t *testing.T) {
 	if totals.charCount != expectedCharCount {
 		t.Errorf("Expected char count %d, got %d", expectedCharCount, totals.charCount)
 	}
+	if totals.byteCount != len(content) {
+		t.Errorf("Expected byte count %d, got %d", len(content), totals.byteCount)
+	}
 }
 
-func TestCountFromStdin(t *testing.T) {
+func TestCountReader(t *testing.T) {
 	input := "abc\ndef ghi jkl"
 	reader := bytes.NewReader([]byte(input))
 
-	counts, err := countFromStdin(reader)
+	counts, err := countReader(reader, encodingUTF8)
 	if err != nil {
 		t.Fatalf("Unexpected error: %v", err)
 	}
 
 	expected := totalCounts{
-		lineCount: 2,
-		wordCount: 4,
-		charCount: 15,
+		lineCount:     1,
+		wordCount:     4,
+		charCount:     15,
+		byteCount:     15,
+		maxLineLength: 11,
 	}
 
 	if counts != expected {
@@ -164,7 +171,44 @@ func TestPrintAllCounts(t *testing.T) {
 		wordFlag: true,
 		charFlag: true,
 	}
-	printAllCounts(&allFlags, &counts)
+	var stdout bytes.Buffer
+	printAllCounts(&stdout, &allFlags, &counts, 7)
+	if expect := "      1       2      11"; stdout.String() != expect {
+		t.Errorf("Expected %q, got %q", expect, stdout.String())
+	}
+}
+
+// expectations are set based on the output of GNU wc
+func TestReadFromStdin(t *testing.T) {
+	file, err := os.Open("test-data/file1.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	var stdout bytes.Buffer
+	if code := readFromStdin(file, &flags{lineFlag: true}, &stdout, io.Discard); code != 0 {
+		t.Errorf("Expected exit code 0, got %d", code)
+	}
+	if expect := "2\n"; stdout.String() != expect {
+		t.Errorf("Expected %q, got %q", expect, stdout.String())
+	}
+
+	// a pipe has no size to size the columns by
+	reader, writer, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+	go func() {
+		writer.WriteString("ab\n")
+		writer.Close()
+	}()
+	stdout.Reset()
+	readFromStdin(reader, &flags{}, &stdout, io.Discard)
+	if expect := "      1       1       3\n"; stdout.String() != expect {
+		t.Errorf("Expected %q, got %q", expect, stdout.String())
+	}
 }
 
 func TestValidateFile(t *testing.T) {
@@ -181,7 +225,19 @@ func TestValidateFile(t *testing.T) {
 		t.Errorf("Expected is-a-directory error, got: msg=%q, code=%d", msg, code)
 	}
 
-	// Case 3: Permission denied
+	// Case 3: Any other open error, such as a symlink loop
+	loop := filepath.Join(dir, "loop")
+	os.Symlink(loop, loop)
+	_, msg, code = validateFile(loop)
+	if code != 1 || msg != fmt.Sprintf("%s: %s: too many levels of symbolic links\n", os.Args[0], loop) {
+		t.Errorf("Expected symlink-loop error, got: msg=%q, code=%d", msg, code)
+	}
+	_, msg, code = validateFile(strings.Repeat("x", 300))
+	if code != 1 || !strings.Contains(msg, "file name too long") {
+		t.Errorf("Expected name-too-long error, got: msg=%q, code=%d", msg, code)
+	}
+
+	// Case 4: Permission denied
 	tmpFile, err := os.CreateTemp("", "testfile")
 	if err != nil {
 		t.Fatalf("Failed to create temp file: %v", err)
@@ -198,3 +254,513 @@ func TestValidateFile(t *testing.T) {
 		t.Errorf("Expected permission-denied error, got: msg=%q, code=%d", msg, code)
 	}
 }
+
+func TestCountReaderSplitInput(t *testing.T) {
+	input := "héllo wörld\n日本語　text\n\xe6\x97a \xf0\x9f\n\xe6end\xc3"
+	for _, enc := range []encoding{encodingUTF8, encodingASCII, encodingLatin1} {
+		expected, err := countReader(strings.NewReader(input), enc)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+
+		// feed the input in two pieces split at every offset, so multi-byte
+		// characters get cut between reads
+		for i := 0; i <= len(input); i++ {
+			c := counter{encoding: enc}
+			c.write([]byte(input[:i]))
+			c.write([]byte(input[i:]))
+			if counts := c.finish(); counts != expected {
+				t.Errorf("encoding %d, split at %d: expected %v, got %v", enc, i, expected, counts)
+			}
+		}
+	}
+}
+
+// expectations are set based on the output of GNU wc, in the C.UTF-8 locale
+// for utf-8 and in the C locale for ascii
+var encodingCountTests = []struct {
+	input    string
+	encoding encoding
+	expect   totalCounts
+}{
+	{"naïve café\n", encodingUTF8, totalCounts{lineCount: 1, wordCount: 2, charCount: 11, byteCount: 13, maxLineLength: 10}},
+	{"naïve café\n", encodingASCII, totalCounts{lineCount: 1, wordCount: 2, charCount: 13, byteCount: 13, maxLineLength: 8}},
+	{"naïve café\n", encodingLatin1, totalCounts{lineCount: 1, wordCount: 2, charCount: 13, byteCount: 13, maxLineLength: 12}},
+	{"日本語 🎉\n", encodingUTF8, totalCounts{lineCount: 1, wordCount: 2, charCount: 6, byteCount: 15, maxLineLength: 9}},
+	{"日本語 🎉\n", encodingASCII, totalCounts{lineCount: 1, wordCount: 0, charCount: 15, byteCount: 15, maxLineLength: 1}},
+	{"a\u00a0b\u2003c", encodingUTF8, totalCounts{lineCount: 0, wordCount: 3, charCount: 5, byteCount: 8, maxLineLength: 5}},
+	{"a\xa0b", encodingLatin1, totalCounts{lineCount: 0, wordCount: 2, charCount: 3, byteCount: 3, maxLineLength: 3}},
+	// invalid bytes are no characters and neither start nor end a word
+	{"\xff\xfe\n", encodingUTF8, totalCounts{lineCount: 1, wordCount: 0, charCount: 1, byteCount: 3, maxLineLength: 0}},
+	{"lone\x80byte", encodingUTF8, totalCounts{lineCount: 0, wordCount: 1, charCount: 8, byteCount: 9, maxLineLength: 8}},
+	{"cut \xe6\x97", encodingUTF8, totalCounts{lineCount: 0, wordCount: 1, charCount: 4, byteCount: 6, maxLineLength: 4}},
+	{"\xe6\x97x", encodingUTF8, totalCounts{lineCount: 0, wordCount: 1, charCount: 1, byteCount: 3, maxLineLength: 1}},
+	// control characters, line separators and unassigned code points are
+	// characters, but neither start nor end a word either
+	{"\x01", encodingUTF8, totalCounts{lineCount: 0, wordCount: 0, charCount: 1, byteCount: 1, maxLineLength: 0}},
+	{"a\x7fb", encodingUTF8, totalCounts{lineCount: 0, wordCount: 1, charCount: 3, byteCount: 3, maxLineLength: 2}},
+	{"\x1b[0m", encodingASCII, totalCounts{lineCount: 0, wordCount: 1, charCount: 4, byteCount: 4, maxLineLength: 3}},
+	{"a\u0085b", encodingUTF8, totalCounts{lineCount: 0, wordCount: 1, charCount: 3, byteCount: 4, maxLineLength: 2}},
+	{"a\u2028b", encodingUTF8, totalCounts{lineCount: 0, wordCount: 1, charCount: 3, byteCount: 5, maxLineLength: 2}},
+	{"\u0378", encodingUTF8, totalCounts{lineCount: 0, wordCount: 0, charCount: 1, byteCount: 2, maxLineLength: 0}},
+	// but the word joiner separates words
+	{"x\u2060y", encodingUTF8, totalCounts{lineCount: 0, wordCount: 2, charCount: 3, byteCount: 5, maxLineLength: 2}},
+}
+
+func TestCountReaderEncodings(t *testing.T) {
+	for _, testCase := range encodingCountTests {
+		counts, err := countReader(strings.NewReader(testCase.input), testCase.encoding)
+		if err != nil {
+			t.Errorf("Unexpected error for input %q: %v", testCase.input, err)
+		}
+		if counts != testCase.expect {
+			t.Errorf("Expected %v, got %v for input %q in encoding %d", testCase.expect, counts, testCase.input, testCase.encoding)
+		}
+	}
+}
+
+// expectations are set based on the output of GNU wc -L in the C.UTF-8 locale
+var maxLineLengthTests = []lineCounterTest{
+	{input: "a\tb\n", expect: 9},
+	{input: "1234567\tx\n", expect: 9},
+	{input: "12345678\tx", expect: 17},
+	{input: "long line\rshort\n", expect: 9},
+	{input: "ab\fc", expect: 2},
+	{input: "e\u0301te\n", expect: 3},
+	{input: "全角ＡＢ\n", expect: 8},
+	{input: "zero\u200bwidth", expect: 9},
+	{input: "\x01\x02ab", expect: 2},
+}
+
+func TestMaxLineLength(t *testing.T) {
+	for _, testCase := range maxLineLengthTests {
+		counts, err := countReader(strings.NewReader(testCase.input), encodingUTF8)
+		if err != nil {
+			t.Errorf("Unexpected error for input %q: %v", testCase.input, err)
+		}
+		if counts.maxLineLength != testCase.expect {
+			t.Errorf("Expected max line length %d, got %d for input %q", testCase.expect, counts.maxLineLength, testCase.input)
+		}
+	}
+}
+
+func TestCountReaderLongLine(t *testing.T) {
+	// longer than the 64KB a bufio.Scanner line may be, and than the read buffer
+	line := strings.Repeat("x", 3*readBufferSize)
+	counts, err := countReader(strings.NewReader(line+"\nshort\n"), encodingUTF8)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if counts.lineCount != 2 || counts.maxLineLength != len(line) {
+		t.Errorf("Expected 2 lines at most %d wide, got %d lines at most %d wide", len(line), counts.lineCount, counts.maxLineLength)
+	}
+}
+
+func TestCountFilesFixtures(t *testing.T) {
+	tests := []struct {
+		path     string
+		encoding encoding
+		expect   string
+	}{
+		{"test-data/multibyte.txt", encodingUTF8, " 3  6 34 55 16 test-data/multibyte.txt\n"},
+		{"test-data/multibyte.txt", encodingASCII, " 3  4 55 55 12 test-data/multibyte.txt\n"},
+		{"test-data/invalid-utf8.txt", encodingUTF8, " 3  4 35 40 16 test-data/invalid-utf8.txt\n"},
+		{"test-data/control-chars.txt", encodingUTF8, " 5  6 46 52 16 test-data/control-chars.txt\n"},
+		{"test-data/control-chars.txt", encodingASCII, " 5  5 52 52 16 test-data/control-chars.txt\n"},
+	}
+	for _, test := range tests {
+		allFlags := flags{lineFlag: true, wordFlag: true, charFlag: true, byteFlag: true, maxLineFlag: true, encoding: test.encoding}
+		var stdout, stderr bytes.Buffer
+		countFiles([]string{test.path}, &allFlags, &stdout, &stderr)
+		if stderr.Len() > 0 {
+			t.Fatalf("Unexpected error: %s", stderr.String())
+		}
+		if stdout.String() != test.expect {
+			t.Errorf("Expected %q, got %q", test.expect, stdout.String())
+		}
+	}
+}
+
+// expectations are set based on the output of GNU wc
+func TestCountFilesColumns(t *testing.T) {
+	tests := []struct {
+		allFlags flags
+		paths    []string
+		expect   string
+	}{
+		{flags{lineFlag: true}, []string{"test-data/file1.txt"}, "2 test-data/file1.txt\n"},
+		{flags{lineFlag: true, wordFlag: true, byteFlag: true}, []string{"test-data/file1.txt"}, "  2  21 125 test-data/file1.txt\n"},
+		{flags{lineFlag: true}, []string{"test-data/file1.txt", "test-data/file2.txt"}, "  2 test-data/file1.txt\n  6 test-data/file2.txt\n  8 total\n"},
+		{flags{byteFlag: true}, []string{"test-data/file1.txt", "nonexistent_file.txt"}, "125 test-data/file1.txt\n125 total\n"},
+		// a directory isn't a regular file, so its size is unknown
+		{flags{lineFlag: true}, []string{"test-data", "test-data/file1.txt"}, "      2 test-data/file1.txt\n      2 total\n"},
+	}
+	for _, test := range tests {
+		var stdout bytes.Buffer
+		countFiles(test.paths, &test.allFlags, &stdout, io.Discard)
+		if stdout.String() != test.expect {
+			t.Errorf("%v: expected %q, got %q", test.paths, test.expect, stdout.String())
+		}
+	}
+}
+
+func TestCountFilesArgumentOrder(t *testing.T) {
+	dir := t.TempDir()
+	var paths []string
+	var expect strings.Builder
+	for i := 0; i < 50; i++ {
+		// make the early files the big ones, so they tend to finish last
+		lines := (50 - i) * 2000
+		path := filepath.Join(dir, fmt.Sprintf("file%02d.txt", i))
+		if err := os.WriteFile(path, []byte(strings.Repeat("word\n", lines)), 0644); err != nil {
+			t.Fatal(err)
+		}
+		paths = append(paths, path)
+		fmt.Fprintf(&expect, "%8d %s\n", lines, path)
+	}
+	// the columns fit the 12750000 bytes of all files together
+	fmt.Fprintf(&expect, "%8d total\n", 2000*50*51/2)
+
+	defer func(workers int) { countWorkers = workers }(countWorkers)
+	for _, workers := range []int{1, 3, 64} {
+		countWorkers = workers
+		for run := 0; run < 5; run++ {
+			var stdout bytes.Buffer
+			if code := countFiles(paths, &flags{lineFlag: true}, &stdout, io.Discard); code != 0 {
+				t.Fatalf("Expected exit code 0, got %d", code)
+			}
+			if stdout.String() != expect.String() {
+				t.Fatalf("%d workers, run %d: expected\n%s\ngot\n%s", workers, run, expect.String(), stdout.String())
+			}
+		}
+	}
+}
+
+func TestReadFiles0From(t *testing.T) {
+	tests := []struct {
+		input   string
+		expect  []string
+		wantErr string
+	}{
+		{input: "", expect: nil},
+		{input: "a.txt\x00dir/b c.txt\x00", expect: []string{"a.txt", "dir/b c.txt"}},
+		{input: "a.txt\x00b.txt", expect: []string{"a.txt", "b.txt"}},
+		{input: "a.txt\x00\x00b.txt", wantErr: "-:2: invalid zero-length file name"},
+	}
+	for _, test := range tests {
+		paths, err := readFiles0From("-", strings.NewReader(test.input))
+		if test.wantErr != "" {
+			if err == nil || err.Error() != test.wantErr {
+				t.Errorf("input %q: expected error %q, got %v", test.input, test.wantErr, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("input %q: unexpected error: %v", test.input, err)
+		}
+		if strings.Join(paths, "|") != strings.Join(test.expect, "|") || len(paths) != len(test.expect) {
+			t.Errorf("input %q: expected %q, got %q", test.input, test.expect, paths)
+		}
+	}
+
+	list := filepath.Join(t.TempDir(), "list")
+	if err := os.WriteFile(list, []byte("test-data/file1.txt\x00"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	paths, err := readFiles0From(list, nil)
+	if err != nil || len(paths) != 1 || paths[0] != "test-data/file1.txt" {
+		t.Errorf("Expected [test-data/file1.txt], got %q, %v", paths, err)
+	}
+	if _, err := readFiles0From(filepath.Join(t.TempDir(), "missing"), nil); err == nil {
+		t.Errorf("Expected an error for a missing list")
+	}
+}
+
+func TestExpandPaths(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"b/two.txt", "a/one.go", "a/.git/config", "a/skip.log", "top.go"} {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte("x\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink("one.go", filepath.Join(dir, "a", "link.go")); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		include, exclude globList
+		expect           []string
+	}{
+		{nil, nil, []string{"a/.git/config", "a/one.go", "a/skip.log", "b/two.txt", "top.go"}},
+		{nil, globList{".git", "*.log"}, []string{"a/one.go", "b/two.txt", "top.go"}},
+		{globList{"*.go", "*.txt"}, nil, []string{"a/one.go", "b/two.txt", "top.go"}},
+		{globList{"*.go"}, globList{"top.*"}, []string{"a/one.go"}},
+	}
+	for _, test := range tests {
+		allFlags := flags{recursive: true, include: test.include, exclude: test.exclude}
+		// a file operand is kept whatever the globs say
+		paths, code := expandPaths([]string{dir, "test-data/file1.txt"}, &allFlags, io.Discard)
+		if code != 0 {
+			t.Errorf("Expected exit code 0, got %d", code)
+		}
+		var expect []string
+		for _, name := range test.expect {
+			expect = append(expect, filepath.Join(dir, name))
+		}
+		expect = append(expect, "test-data/file1.txt")
+		if strings.Join(paths, "|") != strings.Join(expect, "|") {
+			t.Errorf("include %q, exclude %q: expected %q, got %q", test.include, test.exclude, expect, paths)
+		}
+	}
+
+	var stdout bytes.Buffer
+	paths, _ := expandPaths([]string{dir}, &flags{recursive: true}, io.Discard)
+	countFiles(paths, &flags{lineFlag: true, recursive: true}, &stdout, io.Discard)
+	if !strings.HasSuffix(stdout.String(), " 5 total\n") {
+		t.Errorf("Expected a grand total of 5 lines, got %q", stdout.String())
+	}
+
+	// the grand total is printed even when the walk finds a single file
+	stdout.Reset()
+	paths, _ = expandPaths([]string{filepath.Join(dir, "b")}, &flags{recursive: true}, io.Discard)
+	countFiles(paths, &flags{lineFlag: true, recursive: true}, &stdout, io.Discard)
+	if expect := fmt.Sprintf("1 %s\n1 total\n", filepath.Join(dir, "b", "two.txt")); stdout.String() != expect {
+		t.Errorf("Expected %q, got %q", expect, stdout.String())
+	}
+}
+
+func TestExpandPathsSymlinkedRoot(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, "real", "sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"real/one.txt", "real/sub/two.txt"} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte("x\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	link := filepath.Join(dir, "link")
+	if err := os.Symlink("real", link); err != nil {
+		t.Fatal(err)
+	}
+
+	paths, code := expandPaths([]string{link}, &flags{recursive: true}, io.Discard)
+	if code != 0 {
+		t.Errorf("Expected exit code 0, got %d", code)
+	}
+	expect := []string{filepath.Join(link, "one.txt"), filepath.Join(link, "sub", "two.txt")}
+	if strings.Join(paths, "|") != strings.Join(expect, "|") {
+		t.Errorf("Expected %q, got %q", expect, paths)
+	}
+}
+
+func TestGlobListSet(t *testing.T) {
+	var globs globList
+	if err := globs.Set("*.go"); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	if err := globs.Set("["); err == nil {
+		t.Errorf("Expected an error for a bad glob")
+	}
+	if globs.String() != "*.go" {
+		t.Errorf("Expected *.go, got %q", globs.String())
+	}
+}
+
+func TestFlagsCheck(t *testing.T) {
+	if err := (&flags{include: globList{"*.go"}}).check(); err == nil {
+		t.Errorf("Expected an error for --include without -r")
+	}
+	if err := (&flags{exclude: globList{".git"}}).check(); err == nil {
+		t.Errorf("Expected an error for --exclude without -r")
+	}
+	if err := (&flags{recursive: true, include: globList{"*.go"}, exclude: globList{".git"}}).check(); err != nil {
+		t.Errorf("Unexpected error with -r: %v", err)
+	}
+}
+
+func TestNumberWidth(t *testing.T) {
+	regular, err := os.Stat("test-data/file2.txt") // 252 bytes
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, err := os.Stat("test-data")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	all := flags{lineFlag: true, wordFlag: true, byteFlag: true}
+	tests := []struct {
+		allFlags flags
+		inputs   []os.FileInfo
+		expect   int
+	}{
+		{flags{lineFlag: true}, []os.FileInfo{regular}, 1},
+		{flags{lineFlag: true}, []os.FileInfo{dir}, 1},
+		{all, []os.FileInfo{regular}, 3},
+		{all, []os.FileInfo{regular, regular, regular, regular}, 4},
+		{all, []os.FileInfo{regular, dir}, 7},
+		{all, []os.FileInfo{nil, regular}, 3},
+		{all, []os.FileInfo{nil}, 1},
+	}
+	for i, test := range tests {
+		if width := numberWidth(&test.allFlags, test.inputs); width != test.expect {
+			t.Errorf("case %d: expected width %d, got %d", i, test.expect, width)
+		}
+	}
+}
+
+func TestParseEncoding(t *testing.T) {
+	valid := map[string]encoding{
+		"utf-8": encodingUTF8, "UTF8": encodingUTF8,
+		"ascii": encodingASCII, "US-ASCII": encodingASCII, "ANSI_X3.4-1968": encodingASCII,
+		"latin1": encodingLatin1, "ISO-8859-1": encodingLatin1,
+	}
+	for name, expected := range valid {
+		enc, err := parseEncoding(name)
+		if err != nil || enc != expected {
+			t.Errorf("parseEncoding(%q) = %d, %v; expected %d", name, enc, err, expected)
+		}
+	}
+	if _, err := parseEncoding("ebcdic"); err == nil {
+		t.Errorf("Expected an error for an unsupported encoding")
+	}
+}
+
+func TestLocaleEncoding(t *testing.T) {
+	tests := []struct {
+		lcAll, lcCtype, lang string
+		expect               encoding
+	}{
+		{"", "", "", encodingASCII},
+		{"", "", "C", encodingASCII},
+		{"", "", "en_US.UTF-8", encodingUTF8},
+		{"", "", "de_DE.ISO-8859-1@euro", encodingLatin1},
+		{"", "C", "en_US.UTF-8", encodingASCII},
+		{"POSIX", "en_US.UTF-8", "", encodingASCII},
+		{"", "", "en_US", encodingUTF8},
+	}
+	for _, test := range tests {
+		t.Setenv("LC_ALL", test.lcAll)
+		t.Setenv("LC_CTYPE", test.lcCtype)
+		t.Setenv("LANG", test.lang)
+		if enc := localeEncoding(); enc != test.expect {
+			t.Errorf("LC_ALL=%q LC_CTYPE=%q LANG=%q: expected %d, got %d", test.lcAll, test.lcCtype, test.lang, test.expect, enc)
+		}
+	}
+}
+
+// threePassCount is how files used to be counted: one bufio.Scanner pass per
+// count, seeking back to the start in between.
+func threePassCount(file *os.File) (totalCounts, error) {
+	var counts totalCounts
+	passes := []struct {
+		split bufio.SplitFunc
+		count *int
+	}{
+		{bufio.ScanLines, &counts.lineCount},
+		{bufio.ScanWords, &counts.wordCount},
+		{bufio.ScanRunes, &counts.charCount},
+	}
+	for _, pass := range passes {
+		if _, err := file.Seek(0, io.SeekStart); err != nil {
+			return totalCounts{}, err
+		}
+		scanner := bufio.NewScanner(file)
+		scanner.Split(pass.split)
+		for scanner.Scan() {
+			*pass.count++
+		}
+		if err := scanner.Err(); err != nil {
+			return totalCounts{}, err
+		}
+	}
+	return counts, nil
+}
+
+var benchSize = flag.Int64("benchsize", 1<<30, "size in bytes of the file the counting benchmarks read")
+
+// benchFile is the file the counting benchmarks share. It is written once
+// per test binary, as b.TempDir would write it again for every call of
+// every benchmark function, and removed by TestMain.
+var benchFile struct {
+	once sync.Once
+	path string
+	err  error
+}
+
+// benchmarkFile returns a file of -benchsize bytes of mixed ASCII and
+// multi-byte text, writing it on first use.
+func benchmarkFile(b *testing.B) string {
+	b.Helper()
+	benchFile.once.Do(func() {
+		benchFile.path, benchFile.err = writeBenchmarkFile()
+	})
+	if benchFile.err != nil {
+		b.Fatal(benchFile.err)
+	}
+	return benchFile.path
+}
+
+func writeBenchmarkFile() (string, error) {
+	dir, err := os.MkdirTemp("", "wc-bench")
+	if err != nil {
+		return "", err
+	}
+	path := filepath.Join(dir, "bench.txt")
+	file, err := os.Create(path)
+	if err != nil {
+		return path, err
+	}
+	defer file.Close()
+
+	line := []byte("To be, or not to be, that is the question: 日本語のテキスト\n")
+	writer := bufio.NewWriterSize(file, readBufferSize)
+	for written := int64(0); written < *benchSize; written += int64(len(line)) {
+		writer.Write(line)
+	}
+	return path, writer.Flush()
+}
+
+func TestMain(m *testing.M) {
+	code := m.Run()
+	if benchFile.path != "" {
+		os.RemoveAll(filepath.Dir(benchFile.path))
+	}
+	os.Exit(code)
+}
+
+func benchmarkCount(b *testing.B, count func(*os.File) (totalCounts, error)) {
+	path := benchmarkFile(b)
+	info, err := os.Stat(path)
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.SetBytes(info.Size())
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		file, err := os.Open(path)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if _, err := count(file); err != nil {
+			b.Fatal(err)
+		}
+		file.Close()
+	}
+}
+
+func BenchmarkCountSinglePass(b *testing.B) {
+	benchmarkCount(b, func(file *os.File) (totalCounts, error) {
+		return countReader(file, encodingUTF8)
+	})
+}
+
+func BenchmarkCountThreePasses(b *testing.B) {
+	benchmarkCount(b, threePassCount)
+}